@@ -0,0 +1,147 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	annotationTimeEndColumn = "timeend"
+	annotationTextColumn    = "text"
+	annotationTagsColumn    = "tags"
+)
+
+// buildAnnotationsResult converts rows into an annotation frame with time,
+// timeEnd, text and tags fields. When the result has a timeend column, rows
+// become region annotations spanning time to timeend. Rows whose timeend is
+// NULL or before time fall back to point annotations and are counted in the
+// frame metadata. An INTEGER time column is an epoch in the unit of
+// timeColumnType, milliseconds when undeclared.
+func (v *VerticaDatasource) buildAnnotationsResult(rows *sql.Rows, rawSql string, timeColumnType string) (*data.Frame, error) {
+	fields, converters, err := buildFields(rows, &fieldOptions{binary: &binaryFormatter{}})
+	if err != nil {
+		return nil, err
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	if err := epochTimeColumns(fields, converters, colTypes, timeColumnType, epochUnitMilliseconds); err != nil {
+		return nil, err
+	}
+
+	timeIndex := detectTimeColumn(fields)
+	if timeIndex == -1 {
+		return nil, errors.New("no time column found")
+	}
+	timeEndIndex, textIndex, tagsIndex := -1, -1, -1
+	for i, field := range fields {
+		switch {
+		case i == timeIndex:
+		case strings.EqualFold(field.Name, annotationTimeEndColumn) && field.Type() == data.FieldTypeNullableTime:
+			timeEndIndex = i
+		case strings.EqualFold(field.Name, annotationTextColumn):
+			textIndex = i
+		case strings.EqualFold(field.Name, annotationTagsColumn) && field.Type() == data.FieldTypeNullableString:
+			tagsIndex = i
+		}
+	}
+
+	var times []time.Time
+	var timeEnds []*time.Time
+	var texts, tags []*string
+	degraded := 0
+
+	err = scanRows(rows, converters, func(values []interface{}) error {
+		t, ok := values[timeIndex].(*time.Time)
+		if !ok {
+			return nil
+		}
+		times = append(times, *t)
+
+		var timeEnd *time.Time
+		if timeEndIndex != -1 {
+			timeEnd, _ = values[timeEndIndex].(*time.Time)
+			if timeEnd == nil || timeEnd.Before(*t) {
+				timeEnd = nil
+				degraded++
+			}
+		}
+		timeEnds = append(timeEnds, timeEnd)
+
+		var text *string
+		if textIndex != -1 && values[textIndex] != nil {
+			str := valueString(values[textIndex])
+			text = &str
+		}
+		texts = append(texts, text)
+
+		var tag *string
+		if tagsIndex != -1 {
+			tag, _ = values[tagsIndex].(*string)
+		}
+		tags = append(tags, tag)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	frame := data.NewFrame("annotations",
+		data.NewField("time", nil, times),
+		data.NewField("timeEnd", nil, timeEnds),
+		data.NewField("text", nil, texts),
+		data.NewField("tags", nil, tags),
+	)
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString: rawSql,
+	}
+	if degraded > 0 {
+		frame.Meta.Custom = map[string]interface{}{
+			"pointAnnotations": degraded,
+		}
+		frame.Meta.Notices = append(frame.Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d rows have a NULL timeend or one before time and are shown as point annotations", degraded),
+		})
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+)
+
+const (
+	binaryFormatHex    = "hex"
+	binaryFormatBase64 = "base64"
+)
+
+const defaultBinaryMaxBytes = 1024
+
+// binaryFormatter renders the values of binary columns, which the driver
+// returns hex encoded, and counts the values it truncated.
+type binaryFormatter struct {
+	format    string
+	maxBytes  int
+	truncated int
+	// columns holds the indexes of the binary columns of the result.
+	columns map[int]bool
+}
+
+func newBinaryFormatter(config *configArgs) *binaryFormatter {
+	return &binaryFormatter{format: config.BinaryFormat, maxBytes: config.BinaryMaxBytes}
+}
+
+func isBinaryType(databaseTypeName string) bool {
+	switch databaseTypeName {
+	case "varbinary", "long varbinary", "binary":
+		return true
+	default:
+		return false
+	}
+}
+
+// render encodes the hex encoded value in the configured format. Values longer
+// than maxBytes are cut and end with an ellipsis.
+func (f *binaryFormatter) render(value string) string {
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+	truncated := f.maxBytes > 0 && len(raw) > f.maxBytes
+	if truncated {
+		raw = raw[:f.maxBytes]
+		f.truncated++
+	}
+
+	var encoded string
+	if f.format == binaryFormatBase64 {
+		encoded = base64.StdEncoding.EncodeToString(raw)
+	} else {
+		encoded = hex.EncodeToString(raw)
+	}
+	if truncated {
+		encoded += "…"
+	}
+	return encoded
+}
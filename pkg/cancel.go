@@ -0,0 +1,113 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// interruptTimeout bounds interrupting a statement of a cancelled query.
+const interruptTimeout = 10 * time.Second
+
+// currentSession returns the id of the Vertica session of conn.
+func currentSession(ctx context.Context, conn *sql.Conn) (string, error) {
+	var session string
+	err := conn.QueryRowContext(ctx, "SELECT CURRENT_SESSION()").Scan(&session)
+	return session, err
+}
+
+// interruptOnCancel interrupts the statement running in session once ctx is
+// done, through control, a session outside the pool of the query. The driver
+// only stops reading results when ctx is done, the statement itself would run
+// to completion. The returned function stops watching ctx and waits for an
+// interrupt in progress, the caller must call it before releasing the
+// connection of session so the interrupt can't hit the next query on it.
+func interruptOnCancel(ctx context.Context, control *sql.DB, session string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		// both may be ready, a finished query has nothing to interrupt
+		select {
+		case <-done:
+			return
+		default:
+		}
+		interruptCtx, cancel := context.WithTimeout(context.Background(), interruptTimeout)
+		defer cancel()
+		if err := interruptStatement(interruptCtx, control, session); err != nil {
+			log.DefaultLogger.Warn("Interrupting cancelled query failed", "session", session, "error", err)
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// interruptStatement interrupts the statement running in session, if any.
+func interruptStatement(ctx context.Context, db *sql.DB, session string) error {
+	var statement sql.NullInt64
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT statement_id FROM v_monitor.sessions WHERE session_id = %s", quoteLiteral(session))).Scan(&statement)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !statement.Valid {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("SELECT INTERRUPT_STATEMENT(%s, %d)", quoteLiteral(session), statement.Int64))
+	return err
+}
+
+// cancelError replaces the error of a query whose context is done, the driver
+// error it caused says little about why the query stopped.
+func cancelError(ctxErr error, timeout int) error {
+	if errors.Is(ctxErr, context.DeadlineExceeded) && timeout > 0 {
+		return fmt.Errorf("query exceeded %ds timeout", timeout)
+	}
+	return errors.New("query cancelled")
+}
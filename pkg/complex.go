@@ -0,0 +1,94 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// formatComplex renders the text of an ARRAY, SET or ROW value. The pinned
+// driver has no complex types, so such values are recognized by their
+// bracketed text form, which Vertica writes as JSON with ROW fields as object
+// members. Inner values of any type come out as JSON strings or numbers, so
+// nested rows and arrays need no further handling.
+//
+// The value is returned as compact JSON or, for an array with asText set, as
+// its elements joined by commas. Text that is not JSON is returned as is.
+func formatComplex(value string, asText bool) string {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}") {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(trimmed)); err != nil {
+			return value
+		}
+		return compact.String()
+	}
+	if !strings.HasPrefix(trimmed, "[") || !strings.HasSuffix(trimmed, "]") {
+		return value
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	decoder.UseNumber()
+	var elements []interface{}
+	if err := decoder.Decode(&elements); err != nil {
+		return value
+	}
+
+	if !asText {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(trimmed)); err != nil {
+			return value
+		}
+		return compact.String()
+	}
+
+	texts := make([]string, 0, len(elements))
+	for _, element := range elements {
+		switch e := element.(type) {
+		case nil:
+		case string:
+			texts = append(texts, e)
+		case json.Number:
+			texts = append(texts, e.String())
+		default:
+			encoded, err := json.Marshal(e)
+			if err != nil {
+				return value
+			}
+			texts = append(texts, string(encoded))
+		}
+	}
+	return strings.Join(texts, ",")
+}
@@ -34,21 +34,34 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
-	"time"
-
 	_ "github.com/vertica/vertica-sql-go"
 )
 
-func newDatasource() datasource.ServeOpts {
-	ds := &VerticaDatasource{}
-
+func newDatasource(ds *VerticaDatasource) datasource.ServeOpts {
 	return datasource.ServeOpts{
 		QueryDataHandler:   ds,
 		CheckHealthHandler: ds,
@@ -56,16 +69,262 @@ func newDatasource() datasource.ServeOpts {
 }
 
 type VerticaDatasource struct {
+	// mu guards dbs, the connection pools of the datasource instances by ID,
+	// and opening, the locks serializing opening them.
+	mu      sync.Mutex
+	dbs     map[int64]*cachedDB
+	opening map[int64]chan struct{}
+}
+
+// cachedDB is the connection pool of a datasource instance, opened with the
+// settings identified by key.
+type cachedDB struct {
+	db  *sql.DB
+	key string
+	// host is the one of the datasource hosts the pool connects to.
+	host string
+	// control holds a single session outside the pool for statements
+	// controlling the queries of the pool, which may all be in use.
+	control *sql.DB
+	// queries holds a slot per running query, queued counts the queries
+	// waiting for one.
+	queries chan struct{}
+	queued  int64
+}
+
+// close closes the pool and its control session once the queries in flight
+// finished, waiting at most timeout for them. sql.DB.Close does not wait for
+// the connections in use, so close takes every query slot first. It returns
+// the number of queries still running when the pool was closed.
+func (c *cachedDB) close(timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	taken := 0
+wait:
+	for taken < cap(c.queries) {
+		select {
+		case c.queries <- struct{}{}:
+			taken++
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	if err := c.db.Close(); err != nil {
+		log.DefaultLogger.Error(err.Error())
+	}
+	if err := c.control.Close(); err != nil {
+		log.DefaultLogger.Error(err.Error())
+	}
+	// queries still holding the pool fail on the closed pool
+	for i := 0; i < taken; i++ {
+		<-c.queries
+	}
+	return cap(c.queries) - taken
 }
 
+// acquire waits for a query slot until ctx is done. The returned function
+// releases the slot.
+func (c *cachedDB) acquire(ctx context.Context) (func(), error) {
+	atomic.AddInt64(&c.queued, 1)
+	defer atomic.AddInt64(&c.queued, -1)
+	select {
+	case c.queries <- struct{}{}:
+		return func() { <-c.queries }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// poolStats describes the connection pool and the query slots of a datasource
+// instance in the health check details.
+type poolStats struct {
+	OpenConnections int   `json:"openConnections"`
+	InUse           int   `json:"inUse"`
+	Idle            int   `json:"idle"`
+	WaitCount       int64 `json:"waitCount"`
+	RunningQueries  int   `json:"runningQueries"`
+	QueuedQueries   int64 `json:"queuedQueries"`
+}
+
+// stats returns the current poolStats of c.
+func (c *cachedDB) stats() poolStats {
+	dbStats := c.db.Stats()
+	return poolStats{
+		OpenConnections: dbStats.OpenConnections,
+		InUse:           dbStats.InUse,
+		Idle:            dbStats.Idle,
+		WaitCount:       dbStats.WaitCount,
+		RunningQueries:  len(c.queries),
+		QueuedQueries:   atomic.LoadInt64(&c.queued),
+	}
+}
+
+// settingsKey identifies the settings of a datasource instance, it changes
+// whenever they are updated, including its secure settings.
+func settingsKey(settings *backend.DataSourceInstanceSettings) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\x00%s\x00%s\x00%s\x00", settings.Updated.UnixNano(), settings.URL, settings.User, settings.Database)
+	hash.Write(settings.JSONData)
+	keys := make([]string, 0, len(settings.DecryptedSecureJSONData))
+	for key := range settings.DecryptedSecureJSONData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "\x00%s=%s", key, settings.DecryptedSecureJSONData[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+const (
+	formatTable       = "table"
+	formatTimeSeries  = "time_series"
+	formatHeatmap     = "heatmap"
+	formatAnnotations = "annotations"
+)
+
+const (
+	resultShapeWide = "wide"
+)
+
 type queryModel struct {
-	RawSQL string `json:"rawSql"`
+	RawSQL           string   `json:"rawSql"`
+	Format           string   `json:"format"`
+	ResultShape      string   `json:"resultShape"`
+	Fill             string   `json:"fill"`
+	GapThreshold     float64  `json:"gapThreshold"`
+	Downsample       string   `json:"downsample"`
+	TimeColumn       string   `json:"timeColumn"`
+	MetricColumn     string   `json:"metricColumn"`
+	ValueColumns     []string `json:"valueColumns"`
+	TimeColumnType   string   `json:"timeColumnType"`
+	TimeLayout       string   `json:"timeLayout"`
+	Alias            string   `json:"alias"`
+	Transform        string   `json:"transform"`
+	TimeAsString     bool     `json:"timeAsString"`
+	Transpose        bool     `json:"transpose"`
+	Timezone         string   `json:"timezone"`
+	SnapTimeRange    bool     `json:"snapTimeRange"`
+	SearchFilter     string   `json:"searchFilter"`
+	UnshiftTime      bool     `json:"unshiftTime"`
+	RawQuery         bool     `json:"rawQuery"`
+	NumericAsString  bool     `json:"numericAsString"`
+	BigIntAsString   bool     `json:"bigIntAsString"`
+	BigIntColumns    []string `json:"bigIntColumns"`
+	IntervalAsString bool     `json:"intervalAsString"`
+	FullCellValues   bool     `json:"fullCellValues"`
+	ArrayAsText      bool     `json:"arrayAsText"`
+	GeoAsText        bool     `json:"geoAsText"`
+	TimePrecision    string   `json:"timePrecision"`
+
+	// fillInterval is the bucket width of a $__timeGroup macro with a fill
+	// argument. It replaces the query interval when filling.
+	fillInterval time.Duration
+	// fillCalendar is set instead when the buckets are calendar aligned.
+	fillCalendar *calendarBucket
+	// fillOffset shifts the bucket boundaries.
+	fillOffset time.Duration
+	// timeShift is the shift of a $__timeFilterOffset macro.
+	timeShift *timeShift
+}
+
+// canonicalUUID returns uuid in the lower case 8-4-4-4-12 form, so equal
+// UUIDs name the same series. Values that are not a UUID are kept as is.
+func canonicalUUID(uuid string) string {
+	hex := strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	if len(hex) != 32 {
+		return uuid
+	}
+	for _, c := range hex {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return uuid
+		}
+	}
+	return hex[0:8] + "-" + hex[8:12] + "-" + hex[12:16] + "-" + hex[16:20] + "-" + hex[20:32]
+}
+
+// fieldOptions holds the datasource options that affect how column values are
+// converted.
+type fieldOptions struct {
+	binary *binaryFormatter
+	// timestampLocation is the timezone naive TIMESTAMP values are read in.
+	// When nil, the timezone the driver read them in is kept.
+	timestampLocation *time.Location
+	// maxCellChars limits the length of VARCHAR values, 0 means no limit.
+	// truncatedCells counts the values cut.
+	maxCellChars   int
+	truncatedCells int
+	// trimChar strips the padding of CHAR values.
+	trimChar bool
+	// arrayAsText joins the elements of ARRAY and SET values by commas
+	// instead of rendering them as JSON.
+	arrayAsText bool
+	// renamedColumns maps the names given to duplicate columns to the name
+	// they share.
+	renamedColumns map[string]string
+	// unknownTypes lists the columns of types converted by the text fallback.
+	unknownTypes []*unknownType
+}
+
+// unknownType describes a column converted by the text fallback of buildField.
+type unknownType struct {
+	Column      string `json:"column"`
+	VerticaType string `json:"verticaType"`
+	GoType      string `json:"goType,omitempty"`
+}
+
+// newFieldOptions returns the field options of config. A query asking for
+// full cell values lifts the maxCellChars limit.
+func newFieldOptions(config *configArgs, qm queryModel) *fieldOptions {
+	options := &fieldOptions{
+		binary:            newBinaryFormatter(config),
+		timestampLocation: config.timestampLocation,
+		maxCellChars:      config.MaxCellChars,
+		trimChar:          *config.TrimCharPadding,
+		arrayAsText:       qm.ArrayAsText,
+	}
+	if qm.FullCellValues || options.maxCellChars < 0 {
+		options.maxCellChars = 0
+	}
+	return options
 }
 
+// truncateSuffix marks a value cut by truncate.
+const truncateSuffix = "…"
 
-func buildField(colType *sql.ColumnType) (*data.Field, func(interface{}) interface{}, error) {
+// truncate cuts value to maxCellChars runes.
+func (options *fieldOptions) truncate(value string) string {
+	if options.maxCellChars <= 0 || len(value) <= options.maxCellChars {
+		return value
+	}
+	runes := 0
+	for i := range value {
+		if runes == options.maxCellChars {
+			options.truncatedCells++
+			return value[:i] + truncateSuffix
+		}
+		runes++
+	}
+	return value
+}
+
+// inLocation returns t with its wall clock time read in location.
+func inLocation(t time.Time, location *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), location)
+}
+
+func buildField(colType *sql.ColumnType, options *fieldOptions) (*data.Field, func(interface{}) interface{}, error) {
 	// TODO we could use colType.Nullable() to make more efficient arrays when not nullable
-	colName :=  colType.Name()
+	colName := colType.Name()
+
+	// A VMap still binary here could not be decoded by MAPTOSTRING
+	if isVMapColumn(colType) {
+		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
+			t := vmapErrorMarker
+			return &t
+		}, nil
+	}
 
 	//https://github.com/vertica/vertica-sql-go/blob/master/common/types.go
 	//https://github.com/vertica/vertica-sql-go/blob/7b6204c5fc4f44d8b1c4ab6a2d4f6a41f092d70a/rows.go#L101-L118
@@ -76,15 +335,15 @@ func buildField(colType *sql.ColumnType) (*data.Field, func(interface{}) interfa
 			return &t
 		}, nil
 	case "integer":
-		if colName == "time" {
-			return data.NewField(colName, nil, make([]*time.Time, 0)), func(raw interface{}) interface{} {
-				t := time.Unix(int64(raw.(int))/1000, 0)
-				return &t
-			}, nil
-		}
 		return data.NewField(colName, nil, make([]*float64, 0)), func(raw interface{}) interface{} {
 			//TODO Grafana does not support BigInt, float64 it for now
-			t := float64(raw.(int))
+			var t float64
+			switch v := raw.(type) {
+			case int64:
+				t = float64(v)
+			case float64:
+				t = v
+			}
 			return &t
 		}, nil
 	case "float", "numeric":
@@ -92,64 +351,710 @@ func buildField(colType *sql.ColumnType) (*data.Field, func(interface{}) interfa
 			t := raw.(float64)
 			return &t
 		}, nil
-	case "varchar", "long varchar", "char", "uuid", "varbinary", "long varbinary", "binary":
+	case "uuid":
+		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
+			t := canonicalUUID(raw.(string))
+			return &t
+		}, nil
+	case "varbinary", "long varbinary", "binary", "geometry", "geography":
+		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
+			t := options.binary.render(raw.(string))
+			return &t
+		}, nil
+	case dateType:
+		return data.NewField(colName, nil, make([]*time.Time, 0)), func(raw interface{}) interface{} {
+			t, ok := parseDate(raw.(string))
+			if !ok {
+				return nil
+			}
+			return &t
+		}, nil
+	case timeType, timeTZType:
+		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
+			t := formatTimeOfDay(raw.(string))
+			return &t
+		}, nil
+	case intervalDayToSecondType:
+		// Intervals become seconds so they can be graphed with duration units.
+		field := data.NewField(colName, nil, make([]*float64, 0))
+		field.Config = &data.FieldConfig{Unit: "s"}
+		return field, func(raw interface{}) interface{} {
+			t, ok := parseIntervalSeconds(raw.(string))
+			if !ok {
+				return nil
+			}
+			return &t
+		}, nil
+	case "varchar", "long varchar":
+		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
+			t := options.truncate(raw.(string))
+			return &t
+		}, nil
+	case "char":
 		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
 			t := raw.(string)
+			if options.trimChar {
+				t = strings.TrimRight(t, " ")
+			}
 			return &t
 		}, nil
-	case "timestamp", "timestamptz":
+	case intervalYearToMonthType:
+		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
+			t := raw.(string)
+			return &t
+		}, nil
+	case "timestamp":
+		return data.NewField(colName, nil, make([]*time.Time, 0)), func(raw interface{}) interface{} {
+			t := raw.(time.Time)
+			if options.timestampLocation != nil {
+				t = inLocation(t, options.timestampLocation)
+			}
+			return &t
+		}, nil
+	case "timestamptz":
 		return data.NewField(colName, nil, make([]*time.Time, 0)), func(raw interface{}) interface{} {
 			t := raw.(time.Time)
 			return &t
 		}, nil
 	default:
-		return nil, nil, fmt.Errorf("unknown data type: %s", colType.DatabaseTypeName())
+		// Columns the driver has no type for, such as a bare SELECT NULL, are
+		// returned as text so they come out as typed NULLs instead of failing.
+		// This includes ARRAY, SET and ROW columns.
+		unknown := &unknownType{Column: colName, VerticaType: colType.DatabaseTypeName()}
+		options.unknownTypes = append(options.unknownTypes, unknown)
+		return data.NewField(colName, nil, make([]*string, 0)), func(raw interface{}) interface{} {
+			if unknown.GoType == "" {
+				unknown.GoType = fmt.Sprintf("%T", raw)
+			}
+			var t string
+			if b, ok := raw.([]byte); ok {
+				t = string(b)
+			} else {
+				t = fmt.Sprintf("%v", raw)
+			}
+			t = formatComplex(t, options.arrayAsText)
+			return &t
+		}, nil
 	}
 }
 
-func (v *VerticaDatasource) buildTableQueryResult(rows *sql.Rows, rawSql string) (*data.Frame, error) {
-	result := data.NewFrame("results")
+// unitHints maps the column alias suffixes recognized as unit hints to the
+// Grafana unit they stand for.
+var unitHints = map[string]string{
+	"ns":          "ns",
+	"us":          "µs",
+	"ms":          "ms",
+	"s":           "s",
+	"bits":        "bits",
+	"bytes":       "bytes",
+	"kbytes":      "kbytes",
+	"mbytes":      "mbytes",
+	"gbytes":      "gbytes",
+	"percent":     "percent",
+	"percentunit": "percentunit",
+	"bps":         "bps",
+	"Bps":         "Bps",
+	"ops":         "ops",
+	"reqps":       "reqps",
+}
+
+// parseUnitHint splits a column alias like latency__ms into its display name
+// and Grafana unit. Aliases without a known unit suffix are returned as is.
+func parseUnitHint(name string) (string, string) {
+	i := strings.LastIndex(name, "__")
+	if i <= 0 {
+		return name, ""
+	}
+	unit, ok := unitHints[name[i+2:]]
+	if !ok {
+		return name, ""
+	}
+	return name[:i], unit
+}
+
+// renameDuplicateColumns gives every column sharing its name with an earlier
+// column a unique name with a numeric suffix, like id_2, and records the new
+// names in options.
+func renameDuplicateColumns(fields []*data.Field, options *fieldOptions) {
+	used := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		used[field.Name] = true
+	}
+
+	seen := make(map[string]int, len(fields))
+	for _, field := range fields {
+		name := field.Name
+		seen[name]++
+		if seen[name] == 1 {
+			continue
+		}
+		n := seen[name]
+		renamed := fmt.Sprintf("%s_%d", name, n)
+		for used[renamed] {
+			n++
+			renamed = fmt.Sprintf("%s_%d", name, n)
+		}
+		used[renamed] = true
+		field.Name = renamed
+		if options.renamedColumns == nil {
+			options.renamedColumns = make(map[string]string)
+		}
+		options.renamedColumns[renamed] = name
+	}
+}
 
+// buildFields creates an empty field and a value converter for every column of rows.
+// Binary values are rendered by options.binary, which also records the binary
+// columns.
+func buildFields(rows *sql.Rows, options *fieldOptions) ([]*data.Field, []func(interface{}) interface{}, error) {
 	colTypes, err := rows.ColumnTypes()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	converters := make([]func(raw interface{})interface{}, len(colTypes))
+	fields := make([]*data.Field, len(colTypes))
+	converters := make([]func(raw interface{}) interface{}, len(colTypes))
 
 	for i, colType := range colTypes {
-		field, converter, err := buildField(colType)
+		field, converter, err := buildField(colType, options)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if name, unit := parseUnitHint(field.Name); unit != "" {
+			field.Name = name
+			field.Config = &data.FieldConfig{Unit: unit}
 		}
-		result.Fields = append(result.Fields, field)
+		// Inactive with the pinned Vertica driver: it does not implement
+		// ColumnTypePrecisionScale, so DecimalSize never reports a scale and
+		// NUMERIC columns keep Grafana's default decimals. The scale is not
+		// known any other way, the driver reports neither the type modifier
+		// nor the declared type. Drivers that report it set the decimals.
+		if _, scale, ok := colType.DecimalSize(); ok && field.Type() == data.FieldTypeNullableFloat64 {
+			if field.Config == nil {
+				field.Config = &data.FieldConfig{}
+			}
+			decimals := uint16(scale)
+			field.Config.Decimals = &decimals
+		}
+		fields[i] = field
 		converters[i] = converter
+		if isBinaryType(colType.DatabaseTypeName()) || isGeoType(colType.DatabaseTypeName()) {
+			if options.binary.columns == nil {
+				options.binary.columns = make(map[int]bool)
+			}
+			options.binary.columns[i] = true
+		}
+	}
+
+	renameDuplicateColumns(fields, options)
+
+	return fields, converters, nil
+}
+
+// columnMeta describes a result column in the frame metadata.
+type columnMeta struct {
+	Name        string `json:"name"`
+	VerticaType string `json:"verticaType"`
+	GoKind      string `json:"goKind"`
+}
+
+// oidTypeNames names the types the driver only reports by type OID.
+var oidTypeNames = map[string]string{
+	dateType:                "date",
+	timeType:                "time",
+	timeTZType:              "timetz",
+	intervalDayToSecondType: "interval day to second",
+	intervalYearToMonthType: "interval year to month",
+}
+
+// verticaTypeName returns the name of the Vertica type the driver reports as
+// databaseTypeName.
+func verticaTypeName(databaseTypeName string) string {
+	if name, ok := oidTypeNames[databaseTypeName]; ok {
+		return name
+	}
+	return databaseTypeName
+}
+
+// columnsMeta describes the columns of colTypes with the Vertica type and the
+// Go kind of the field they are converted to.
+func columnsMeta(colTypes []*sql.ColumnType, fields []*data.Field) []columnMeta {
+	columns := make([]columnMeta, len(colTypes))
+	for i, colType := range colTypes {
+		columns[i] = columnMeta{Name: colType.Name(), VerticaType: verticaTypeName(colType.DatabaseTypeName())}
+		if i < len(fields) {
+			columns[i].GoKind = fields[i].Type().ItemTypeString()
+		}
+	}
+	return columns
+}
+
+// scanTarget returns a reusable scan destination for a column of colType and
+// a function reading the scanned value back in the form the driver returns
+// it, or nil for NULL. Columns of types not listed are scanned dynamically.
+func scanTarget(colType *sql.ColumnType) (interface{}, func() interface{}) {
+	switch colType.DatabaseTypeName() {
+	case "boolean":
+		var v sql.NullBool
+		return &v, func() interface{} {
+			if !v.Valid {
+				return nil
+			}
+			return v.Bool
+		}
+	case "integer":
+		var v nullInteger
+		return &v, func() interface{} {
+			return v.value
+		}
+	case "float", "numeric":
+		var v sql.NullFloat64
+		return &v, func() interface{} {
+			if !v.Valid {
+				return nil
+			}
+			return v.Float64
+		}
+	case "varchar", "long varchar", "char", "uuid", "varbinary", "long varbinary", "binary":
+		var v sql.NullString
+		return &v, func() interface{} {
+			if !v.Valid {
+				return nil
+			}
+			return v.String
+		}
+	case "timestamp", "timestamptz":
+		var v sql.NullTime
+		return &v, func() interface{} {
+			if !v.Valid {
+				return nil
+			}
+			return v.Time
+		}
+	default:
+		var v interface{}
+		return &v, func() interface{} {
+			return v
+		}
+	}
+}
+
+// nullInteger scans an INTEGER value of whatever width the driver returns it
+// in as an int64. An unsigned value past the int64 range is kept as a float64
+// instead of failing the scan of the whole result.
+type nullInteger struct {
+	value interface{}
+}
+
+func (n *nullInteger) Scan(src interface{}) error {
+	n.value = nil
+	switch v := src.(type) {
+	case nil:
+	case int, int8, int16, int32, int64:
+		n.value = reflect.ValueOf(v).Int()
+	case uint, uint8, uint16, uint32, uint64:
+		if u := reflect.ValueOf(v).Uint(); u > math.MaxInt64 {
+			n.value = float64(u)
+		} else {
+			n.value = int64(u)
+		}
+	default:
+		var i sql.NullInt64
+		if err := i.Scan(src); err != nil {
+			return err
+		}
+		if i.Valid {
+			n.value = i.Int64
+		}
+	}
+	return nil
+}
+
+// scanRows scans every remaining row, converts its values and passes them to fn.
+// Each column is scanned into a target of its declared type. SQL NULL values
+// are passed as nil. The slice is reused between calls.
+func scanRows(rows *sql.Rows, converters []func(interface{}) interface{}, fn func(values []interface{}) error) error {
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return err
 	}
 
-	// Build rows
-	rowIn := make([]interface{}, len(colTypes))
-	for ct := range rowIn {
-		var ii interface{}
-		rowIn[ct] = &ii
+	targets := make([]interface{}, len(colTypes))
+	readers := make([]func() interface{}, len(colTypes))
+	for i, colType := range colTypes {
+		targets[i], readers[i] = scanTarget(colType)
 	}
+	values := make([]interface{}, len(converters))
 
 	for rows.Next() {
-		if err := rows.Scan(rowIn...); err != nil {
-			return nil, err
+		if err := rows.Scan(targets...); err != nil {
+			return err
 		}
 
-		for i, v := range rowIn {
-			raw := *(v.(*interface{}))
+		for i, read := range readers {
+			raw := read()
 			if raw == nil {
-				result.Fields[i].Append(nil)
+				values[i] = nil
+			} else {
+				values[i] = converters[i](raw)
+			}
+		}
+
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// isHiddenColumn reports whether a column is a helper column whose alias starts
+// with a double underscore. Hidden columns can be used for grouping and naming
+// but are left out of the returned data.
+func isHiddenColumn(name string) bool {
+	return strings.HasPrefix(name, "__") && name != "__text" && name != "__value"
+}
+
+// hiddenColumnNames returns the names of the hidden columns among fields.
+func hiddenColumnNames(fields []*data.Field) []string {
+	var names []string
+	for _, field := range fields {
+		if isHiddenColumn(field.Name) {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// valueString formats a converted, non NULL value as text.
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case *string:
+		return *v
+	case *float64:
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// nonFiniteString returns the text used for NaN and infinite table values.
+func nonFiniteString(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	default:
+		return "-Inf"
+	}
+}
+
+// replaceNonFinite rewrites NaN and infinite values of the float columns of
+// frame. In nonFiniteString mode a column holding such values becomes a string
+// column, otherwise the values become NULL. It returns the number of values
+// replaced.
+func replaceNonFinite(frame *data.Frame, mode string) int {
+	replaced := 0
+	for i, field := range frame.Fields {
+		if field.Type() != data.FieldTypeNullableFloat64 {
+			continue
+		}
+
+		count := 0
+		for row := 0; row < field.Len(); row++ {
+			if f, ok := field.At(row).(*float64); ok && f != nil && (math.IsNaN(*f) || math.IsInf(*f, 0)) {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		replaced += count
+
+		if mode != nonFiniteModeString {
+			for row := 0; row < field.Len(); row++ {
+				if f, ok := field.At(row).(*float64); ok && f != nil && (math.IsNaN(*f) || math.IsInf(*f, 0)) {
+					field.Set(row, nil)
+				}
+			}
+			continue
+		}
+
+		values := make([]*string, field.Len())
+		for row := range values {
+			f, ok := field.At(row).(*float64)
+			if !ok || f == nil {
+				continue
+			}
+			var str string
+			if math.IsNaN(*f) || math.IsInf(*f, 0) {
+				str = nonFiniteString(*f)
 			} else {
-				result.Fields[i].Append(converters[i](raw))
+				str = strconv.FormatFloat(*f, 'g', -1, 64)
+			}
+			values[row] = &str
+		}
+		frame.Fields[i] = data.NewField(field.Name, field.Labels, values)
+	}
+	return replaced
+}
+
+// formatTimeColumns turns every timestamp column of frame into a column of
+// RFC3339 strings, keeping the offset the value was returned with.
+func formatTimeColumns(frame *data.Frame) {
+	for i, field := range frame.Fields {
+		if field.Type() != data.FieldTypeNullableTime {
+			continue
+		}
+		values := make([]*string, field.Len())
+		for row := range values {
+			if t, ok := field.At(row).(*time.Time); ok && t != nil {
+				str := t.Format(time.RFC3339Nano)
+				values[row] = &str
+			}
+		}
+		frame.Fields[i] = data.NewField(field.Name, field.Labels, values)
+	}
+}
+
+// float64Digits is the number of significant decimal digits a float64 holds
+// exactly.
+const float64Digits = 15
+
+// significantDigits returns the number of significant decimal digits of the
+// shortest representation of f.
+func significantDigits(f float64) int {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	mantissa := strconv.FormatFloat(math.Abs(f), 'e', -1, 64)
+	mantissa = mantissa[:strings.IndexByte(mantissa, 'e')]
+	return len(strings.Replace(mantissa, ".", "", 1))
+}
+
+// formatNumericColumns checks the NUMERIC columns of frame, described by
+// colTypes, for values that may have lost precision and, with asString set,
+// turns them into string columns. The driver parses NUMERIC values as float64,
+// so digits beyond float64 precision are gone before they reach the plugin;
+// wrapColumns casts them to VARCHAR first when asString is set, what is left
+// here are the columns of a query that could not be wrapped. It returns the
+// number of values that may have lost precision.
+func formatNumericColumns(frame *data.Frame, colTypes []*sql.ColumnType, asString bool) int {
+	imprecise := 0
+	for i, colType := range colTypes {
+		if colType.DatabaseTypeName() != "numeric" || i >= len(frame.Fields) {
+			continue
+		}
+		field := frame.Fields[i]
+		values := make([]*string, field.Len())
+		for row := range values {
+			f, ok := field.At(row).(*float64)
+			if !ok || f == nil {
+				continue
+			}
+			if significantDigits(*f) > float64Digits {
+				imprecise++
+			}
+			str := strconv.FormatFloat(*f, 'f', -1, 64)
+			values[row] = &str
+		}
+		if asString {
+			frame.Fields[i] = data.NewField(field.Name, field.Labels, values)
+			frame.Fields[i].Config = field.Config
+		}
+	}
+	return imprecise
+}
+
+// maxSafeInteger is the largest integer a float64, and so JavaScript, holds
+// exactly.
+const maxSafeInteger = 1<<53 - 1
+
+// keepExactIntegers switches the integer columns among fields to int64 values
+// so they can be rendered as strings without losing digits. It returns the
+// indexes of the switched columns.
+func keepExactIntegers(fields []*data.Field, converters []func(interface{}) interface{}, colTypes []*sql.ColumnType) []int {
+	var indexes []int
+	for i, colType := range colTypes {
+		if colType.DatabaseTypeName() != "integer" || fields[i].Type() != data.FieldTypeNullableFloat64 {
+			continue
+		}
+		config := fields[i].Config
+		fields[i] = data.NewField(fields[i].Name, fields[i].Labels, make([]*int64, 0))
+		fields[i].Config = config
+		converters[i] = func(raw interface{}) interface{} {
+			t, ok := raw.(int64)
+			if !ok {
+				// an unsigned value past the int64 range
+				return nil
+			}
+			return &t
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// formatExactIntegers finishes the columns switched by keepExactIntegers. A
+// column named in stringColumns, or with allLarge set holding a value beyond
+// maxSafeInteger, becomes a string column as a whole so its type does not
+// depend on the row. Other columns become float64 columns as usual. It
+// returns the names of the columns returned as strings.
+func formatExactIntegers(frame *data.Frame, indexes []int, allLarge bool, stringColumns []string) []string {
+	var names []string
+	for _, i := range indexes {
+		field := frame.Fields[i]
+		asString := false
+		for _, name := range stringColumns {
+			if name == field.Name {
+				asString = true
+			}
+		}
+		for row := 0; allLarge && !asString && row < field.Len(); row++ {
+			if v, ok := field.At(row).(*int64); ok && v != nil && (*v > maxSafeInteger || *v < -maxSafeInteger) {
+				asString = true
+			}
+		}
+
+		var replacement *data.Field
+		if asString {
+			values := make([]*string, field.Len())
+			for row := range values {
+				if v, ok := field.At(row).(*int64); ok && v != nil {
+					str := strconv.FormatInt(*v, 10)
+					values[row] = &str
+				}
+			}
+			replacement = data.NewField(field.Name, field.Labels, values)
+			names = append(names, field.Name)
+		} else {
+			values := make([]*float64, field.Len())
+			for row := range values {
+				if v, ok := field.At(row).(*int64); ok && v != nil {
+					f := float64(*v)
+					values[row] = &f
+				}
+			}
+			replacement = data.NewField(field.Name, field.Labels, values)
+		}
+		replacement.Config = field.Config
+		frame.Fields[i] = replacement
+	}
+	return names
+}
+
+func (v *VerticaDatasource) buildTableQueryResult(rows *sql.Rows, qm queryModel, config *configArgs) (*data.Frame, error) {
+	result := data.NewFrame("results")
+
+	options := newFieldOptions(config, qm)
+	binary := options.binary
+	fields, converters, err := buildFields(rows, options)
+	if err != nil {
+		return nil, err
+	}
+	result.Fields = fields
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	// tables always read an undeclared INTEGER time column as milliseconds
+	if err := epochTimeColumns(result.Fields, converters, colTypes, qm.TimeColumnType, epochUnitMilliseconds); err != nil {
+		return nil, err
+	}
+	bigIntAsString := qm.BigIntAsString || config.BigIntAsString
+	var exactIntegers []int
+	if bigIntAsString || len(qm.BigIntColumns) > 0 {
+		exactIntegers = keepExactIntegers(result.Fields, converters, colTypes)
+	}
+
+	err = scanRows(rows, converters, func(values []interface{}) error {
+		for i, value := range values {
+			result.Fields[i].Append(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stringIntegers := formatExactIntegers(result, exactIntegers, bigIntAsString, qm.BigIntColumns)
+	impreciseNumerics := formatNumericColumns(result, colTypes, qm.NumericAsString || config.NumericAsString)
+	formatDateColumns(result, colTypes)
+	if qm.IntervalAsString || config.IntervalAsString {
+		formatIntervalColumns(result, colTypes)
+	}
+	columns := columnsMeta(colTypes, result.Fields)
+
+	hiddenColumns := hiddenColumnNames(result.Fields)
+	if len(hiddenColumns) > 0 {
+		visible := result.Fields[:0]
+		for _, field := range result.Fields {
+			if !isHiddenColumn(field.Name) {
+				visible = append(visible, field)
 			}
 		}
+		result.Fields = visible
+	}
+
+	if qm.TimeAsString || config.TimeAsString {
+		formatTimeColumns(result)
 	}
 
 	meta := data.FrameMeta{
-		ExecutedQueryString: rawSql,
+		ExecutedQueryString: qm.RawSQL,
+		Custom:              map[string]interface{}{},
+	}
+	if replaced := replaceNonFinite(result, config.NonFiniteFloats); replaced > 0 {
+		meta.Custom["nonFiniteValues"] = replaced
+	}
+	if len(hiddenColumns) > 0 {
+		meta.Custom["hiddenColumns"] = hiddenColumns
+	}
+	if len(stringIntegers) > 0 {
+		meta.Custom["bigIntColumns"] = stringIntegers
+	}
+	meta.Custom["columns"] = columns
+	if len(options.renamedColumns) > 0 {
+		meta.Custom["renamedColumns"] = options.renamedColumns
+	}
+	if len(options.unknownTypes) > 0 {
+		meta.Custom["unknownTypes"] = options.unknownTypes
+	}
+	meta.Custom["rowCount"] = result.Rows()
+	if options.truncatedCells > 0 {
+		meta.Custom["truncatedCells"] = options.truncatedCells
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     fmt.Sprintf("%d values were truncated to %d characters", options.truncatedCells, options.maxCellChars),
+		})
+	}
+	if binary.truncated > 0 {
+		meta.Custom["truncatedBinaryValues"] = binary.truncated
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     fmt.Sprintf("%d binary values were truncated to %d bytes", binary.truncated, binary.maxBytes),
+		})
+	}
+	if impreciseNumerics > 0 {
+		meta.Custom["impreciseNumerics"] = impreciseNumerics
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d NUMERIC values exceed float64 precision and may have lost digits, cast them to VARCHAR to keep every digit", impreciseNumerics),
+		})
+	}
+
+	if qm.Transpose {
+		if rowCount := result.Rows(); rowCount == 1 {
+			result = transposeRow(result)
+		} else {
+			meta.Custom["transpose"] = fmt.Sprintf("skipped, the result has %d rows", rowCount)
+		}
 	}
 
 	result.Meta = &meta
@@ -157,6 +1062,112 @@ func (v *VerticaDatasource) buildTableQueryResult(rows *sql.Rows, rawSql string)
 	return result, nil
 }
 
+// transposeRow turns the single row of frame into a metric column holding the
+// column names and a value column holding the values. The value column keeps
+// the column type when all columns share it and holds strings otherwise.
+func transposeRow(frame *data.Frame) *data.Frame {
+	names := make([]string, len(frame.Fields))
+	sameType := true
+	for i, field := range frame.Fields {
+		names[i] = field.Name
+		if field.Type() != frame.Fields[0].Type() {
+			sameType = false
+		}
+	}
+
+	var values *data.Field
+	if sameType && len(frame.Fields) > 0 {
+		values = data.NewFieldFromFieldType(frame.Fields[0].Type(), len(frame.Fields))
+		for i, field := range frame.Fields {
+			values.Set(i, field.At(0))
+		}
+	} else {
+		strs := make([]*string, len(frame.Fields))
+		for i, field := range frame.Fields {
+			if _, ok := field.ConcreteAt(0); ok {
+				str := valueString(field.At(0))
+				strs[i] = &str
+			}
+		}
+		values = data.NewField("value", nil, strs)
+	}
+	values.Name = "value"
+
+	return data.NewFrame(frame.Name, data.NewField("metric", nil, names), values)
+}
+
+// snapTimeRange widens timeRange to whole intervals: From down and To up to
+// the nearest interval boundary.
+func snapTimeRange(timeRange backend.TimeRange, interval time.Duration) backend.TimeRange {
+	to := alignDown(timeRange.To, interval)
+	if to.Before(timeRange.To) {
+		to = to.Add(interval)
+	}
+	return backend.TimeRange{
+		From: alignDown(timeRange.From, interval),
+		To:   to,
+	}
+}
+
+// setCustomMeta records a datasource specific value in the metadata of the
+// first frame.
+func setCustomMeta(frames []*data.Frame, key string, value interface{}) {
+	if len(frames) == 0 {
+		return
+	}
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	if frames[0].Meta.Custom == nil {
+		frames[0].Meta.Custom = map[string]interface{}{}
+	}
+	frames[0].Meta.Custom[key] = value
+}
+
+// addNotice shows notice on the first frame.
+func addNotice(frames []*data.Frame, notice data.Notice) {
+	if len(frames) == 0 {
+		return
+	}
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Notices = append(frames[0].Meta.Notices, notice)
+}
+
+// sessionTimezone returns the timezone the Vertica session should use for a
+// query: the datasource override if set, otherwise the dashboard timezone.
+// An empty result keeps the server default. The driver reads the offsets of
+// TIMESTAMPTZ values as whole hours, a timezone with another offset during
+// timeRange falls back to the server default rather than returning zero
+// times, with a notice saying why.
+func sessionTimezone(qm queryModel, config *configArgs, timeRange backend.TimeRange) (string, string, error) {
+	timezone := config.Timezone
+	if timezone == "" {
+		timezone = qm.Timezone
+	}
+
+	switch strings.ToLower(timezone) {
+	case "", "browser":
+		// The frontend resolves the browser timezone, older ones send it as is.
+		return "", "", nil
+	case "utc":
+		return "UTC", "", nil
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid timezone %q", timezone)
+	}
+	for _, t := range []time.Time{timeRange.From, timeRange.To} {
+		if _, offset := t.In(location).Zone(); offset%3600 != 0 {
+			return "", fmt.Sprintf("timezone %s has an offset of %s, the Vertica driver only reads whole hour offsets: the query ran in the server timezone, set a datasource timezone to query in another zone",
+				timezone, time.Duration(offset)*time.Second), nil
+		}
+	}
+	return timezone, "", nil
+}
+
 func (v *VerticaDatasource) query(ctx context.Context, req *backend.QueryDataRequest, query backend.DataQuery) (response backend.DataResponse) {
 	// Unmarshal the json into our queryModel
 	var qm queryModel
@@ -165,37 +1176,180 @@ func (v *VerticaDatasource) query(ctx context.Context, req *backend.QueryDataReq
 		return
 	}
 
-	qm.RawSQL, response.Error = sanitizeAndInterpolateMacros(qm.RawSQL, query)
+	var config *configArgs
+	config, response.Error = loadConfigArgs(req.PluginContext.DataSourceInstanceSettings)
+	if response.Error != nil {
+		return
+	}
+	if config.QueryTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.QueryTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	defer func() {
+		if response.Error != nil && ctx.Err() != nil {
+			response.Error = cancelError(ctx.Err(), int(config.QueryTimeoutSeconds))
+		}
+	}()
+
+	snapped := false
+	if (qm.SnapTimeRange || config.SnapTimeRange) && qm.Format != "" && qm.Format != formatTable && query.Interval > 0 {
+		query.TimeRange = snapTimeRange(query.TimeRange, query.Interval)
+		snapped = true
+	}
+	defer func() {
+		if snapped && response.Error == nil {
+			setCustomMeta(response.Frames, "snappedTimeRange", map[string]string{
+				"from": query.TimeRange.From.Format(time.RFC3339Nano),
+				"to":   query.TimeRange.To.Format(time.RFC3339Nano),
+			})
+		}
+	}()
+
+	var timezone string
+	var timezoneNotice string
+	timezone, timezoneNotice, response.Error = sessionTimezone(qm, config, query.TimeRange)
 	if response.Error != nil {
 		return
 	}
+	if timezoneNotice != "" {
+		defer func() {
+			addNotice(response.Frames, data.Notice{Severity: data.NoticeSeverityWarning, Text: timezoneNotice})
+		}()
+	}
 
-	var db *sql.DB
-	db, response.Error = v.getDB(ctx, req.PluginContext)
+	location := time.UTC
+	if timezone != "" {
+		location, response.Error = time.LoadLocation(timezone)
+		if response.Error != nil {
+			return
+		}
+	}
+
+	macros := &macroState{}
+	if qm.RawQuery {
+		defer func() {
+			if response.Error == nil {
+				setCustomMeta(response.Frames, "macrosSkipped", true)
+			}
+		}()
+	} else {
+		qm.RawSQL, macros, response.Error = sanitizeAndInterpolateMacros(qm.RawSQL, query, qm.SearchFilter, config, location)
+		if response.Error != nil {
+			return
+		}
+	}
+	if len(macros.expansions) > 0 {
+		defer func() {
+			if response.Error == nil {
+				setCustomMeta(response.Frames, "macroExpansions", macros.expansions)
+			}
+		}()
+	}
+	if response.Error = applyMacroState(&qm, macros); response.Error != nil {
+		return
+	}
+
+	var cached *cachedDB
+	cached, response.Error = v.getDB(ctx, req.PluginContext)
+	if response.Error != nil {
+		return
+	}
+	db := cached.db
+
+	var release func()
+	release, response.Error = cached.acquire(ctx)
 	if response.Error != nil {
 		return
 	}
-	defer db.Close()
+	defer release()
+
+	// a node restarting refuses connections and drops the pooled ones for a moment
+	var conn *sql.Conn
+	var session string
+	retries, err := retryTransient(ctx, func() (err error) {
+		conn, session, err = openSession(ctx, db, timezone)
+		return err
+	})
+	if retries > 0 {
+		defer func() {
+			setCustomMeta(response.Frames, "retries", retries)
+		}()
+	}
+	if err != nil {
+		if isSessionLimitError(err) {
+			err = sessionLimitError(err, config)
+		} else if isTransientError(err) {
+			// the host may be down, the next query fails over to a backup host
+			v.invalidate(req.PluginContext.DataSourceInstanceSettings.ID, cached)
+		}
+		response.Error = err
+		return
+	}
+	defer conn.Close()
 
+	if timezone != "" {
+		// the session goes back to the pool, other queries expect its default
+		// timezone: one that cannot be reset is discarded instead
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), "SET TIMEZONE TO DEFAULT"); err != nil {
+				log.DefaultLogger.Error(err.Error())
+				conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			}
+		}()
+	}
+	defer interruptOnCancel(ctx, cached.control, session)()
+
+	// only tables render NUMERIC columns as strings
+	tableFormat := qm.Format != formatTimeSeries && qm.Format != formatHeatmap && qm.Format != formatAnnotations
+	numericAsString := tableFormat && (qm.NumericAsString || config.NumericAsString)
 	var rows *sql.Rows
-	rows, response.Error = db.QueryContext(ctx, qm.RawSQL)
+	rows, qm.RawSQL, response.Error = queryColumns(ctx, conn, qm.RawSQL, qm.GeoAsText || config.GeoAsText, numericAsString)
 	if response.Error != nil {
 		return
 	}
 
 	defer func() {
 		err := rows.Close()
-		if err != nil{
+		if err != nil {
 			log.DefaultLogger.Error(err.Error())
 		}
 	}()
 
+	if qm.Format == formatTimeSeries || qm.Format == formatHeatmap {
+		var frames []*data.Frame
+		if qm.Format == formatHeatmap {
+			frames, response.Error = v.buildHeatmapResult(rows, qm, query, config)
+		} else {
+			frames, response.Error = v.buildSeriesTimeSeriesResult(rows, qm, query, config)
+		}
+		if response.Error != nil {
+			return
+		}
+		response.Frames = append(response.Frames, frames...)
+		return response
+	}
+
 	var frame *data.Frame
-	frame, response.Error = v.buildTableQueryResult(rows, qm.RawSQL)
+	if qm.Format == formatAnnotations {
+		frame, response.Error = v.buildAnnotationsResult(rows, qm.RawSQL, qm.TimeColumnType)
+		if response.Error != nil {
+			return
+		}
+		response.Frames = append(response.Frames, frame)
+		return response
+	}
+
+	frame, response.Error = v.buildTableQueryResult(rows, qm, config)
 	if response.Error != nil {
 		return
 	}
-	if frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
+	if qm.ResultShape == resultShapeWide {
+		frame, response.Error = pivotWide(frame)
+		if response.Error != nil {
+			return
+		}
+	} else if frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
 		fm := data.FillMissing{
 			Mode: data.FillModeNull,
 		}
@@ -211,48 +1365,410 @@ func (v *VerticaDatasource) query(ctx context.Context, req *backend.QueryDataReq
 	return response
 }
 
+// applyMacroState carries what the macros of qm asked for over to qm.
+func applyMacroState(qm *queryModel, macros *macroState) error {
+	if macros.fillMode != fillModeNone {
+		if qm.Format != formatTimeSeries {
+			return errors.New("fill requires time_series format")
+		}
+		qm.Fill = macros.fillMode
+		qm.fillInterval = macros.fillInterval
+		qm.fillCalendar = macros.fillCalendar
+		qm.fillOffset = macros.fillOffset
+	}
+	qm.timeShift = macros.timeShift
+	if qm.TimeColumnType == "" && macros.epochUnit != "" {
+		qm.TimeColumnType = macros.epochUnit
+	}
+	return nil
+}
+
 func (v *VerticaDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
-	defer func() { if r := recover(); r != nil {
-		log.DefaultLogger.Error(fmt.Sprint(r))
-	}}()
+	defer func() {
+		if r := recover(); r != nil {
+			log.DefaultLogger.Error(fmt.Sprint(r))
+		}
+	}()
+
+	// the queries run concurrently, each on its own connection of the pool
+	responses := make([]backend.DataResponse, len(req.Queries))
+	var wg sync.WaitGroup
+	for i, q := range req.Queries {
+		wg.Add(1)
+		go func(i int, q backend.DataQuery) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					log.DefaultLogger.Error(fmt.Sprint(r))
+					responses[i] = backend.DataResponse{Error: fmt.Errorf("query failed: %v", r)}
+				}
+			}()
+			responses[i] = v.query(ctx, req, q)
+		}(i, q)
+	}
+	wg.Wait()
 
 	response := backend.NewQueryDataResponse()
-	for _, q := range req.Queries {
-		response.Responses[q.RefID] = v.query(ctx, req, q)
+	for i, q := range req.Queries {
+		response.Responses[q.RefID] = responses[i]
 	}
 
 	return response, nil
 }
 
 func (v *VerticaDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	db, err := v.getDB(ctx, req.PluginContext)
+	config, err := loadConfigArgs(req.PluginContext.DataSourceInstanceSettings)
+	var cached *cachedDB
+	if err == nil {
+		cached, err = v.getDB(ctx, req.PluginContext)
+	}
+	if err == nil {
+		// a cached pool was pinged when opened, the server may be gone since
+		err = ping(ctx, cached.db, cached.host, config.connectionTimeout())
+	}
 	if err != nil {
-		return  &backend.CheckHealthResult{
-			Status: backend.HealthStatusError,
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
 			Message: err.Error(),
 		}, nil
 	}
-	defer db.Close()
 
-	return &backend.CheckHealthResult{
+	result := &backend.CheckHealthResult{
 		Status:  backend.HealthStatusOk,
-		Message: "Data source is working",
-	}, nil
+		Message: fmt.Sprintf("Data source is working, connected to %s", cached.host),
+	}
+	if config.Subcluster != "" {
+		result.Message += fmt.Sprintf(" on subcluster %s", config.Subcluster)
+	}
+	if config.TLSSkipVerify {
+		result.Message += ", but TLS certificate verification is disabled"
+	}
+	result.JSONDetails, _ = json.Marshal(map[string]poolStats{"pool": cached.stats()})
+	return result, nil
+}
+
+// defaultPort is the port of Vertica unless the host names another.
+const defaultPort = "5433"
+
+// verticaScheme is the scheme of the connection URLs of the driver.
+const verticaScheme = "vertica://"
+
+// normalizeHost checks that a host of the URL of a datasource instance is
+// host[:port], IPv6 addresses bracketed when followed by a port, and returns it
+// with its port. A vertica:// scheme, in any case, or trailing slash pasted
+// along is dropped.
+func normalizeHost(host string) (string, error) {
+	trimmed := host
+	if len(trimmed) >= len(verticaScheme) && strings.EqualFold(trimmed[:len(verticaScheme)], verticaScheme) {
+		trimmed = trimmed[len(verticaScheme):]
+	}
+	trimmed = strings.TrimSuffix(trimmed, "/")
+	if ip := net.ParseIP(trimmed); ip != nil && ip.To4() == nil {
+		trimmed = "[" + trimmed + "]"
+	}
+	parsed, err := url.Parse("//" + trimmed)
+	if err != nil || parsed.Host != trimmed || parsed.User != nil || parsed.Hostname() == "" {
+		return "", fmt.Errorf("URL must be host:port, got %q", host)
+	}
+	port := parsed.Port()
+	if port == "" {
+		if strings.HasSuffix(trimmed, ":") {
+			return "", fmt.Errorf("URL must be host:port, got %q", host)
+		}
+		port = defaultPort
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("URL must be host:port with a port from 1 to 65535, got %q", host)
+	}
+	return net.JoinHostPort(parsed.Hostname(), port), nil
+}
+
+// parseHosts splits the URL of a datasource instance into its hosts, the
+// primary first and then its backup hosts, each normalized by normalizeHost.
+// Empty entries, such as after a trailing comma, are skipped.
+func parseHosts(hosts string) ([]string, error) {
+	var parsed []string
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		host, err := normalizeHost(host)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, host)
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("URL must be host:port, got %q", hosts)
+	}
+	return parsed, nil
 }
 
-func openConnection(settings *backend.DataSourceInstanceSettings) (*sql.DB, error) {
-	password :=  settings.DecryptedSecureJSONData["password"]
-	connStr := fmt.Sprintf("vertica://%s:%s@%s/%s", settings.User, password, settings.URL, settings.Database)
-	return sql.Open("vertica", connStr)
+// sqlOpen opens the connection pools. Tests replace it to open pools of a fake
+// driver.
+var sqlOpen = sql.Open
+
+func openConnection(settings *backend.DataSourceInstanceSettings, config *configArgs, host string) (*sql.DB, error) {
+	return sqlOpen("vertica", connectionURL(settings, config, host))
+}
+
+// connectionURL returns the URL the driver connects to host with. The driver
+// reads it back with url.Parse, so the credentials and database are escaped
+// by url.URL rather than pasted in.
+func connectionURL(settings *backend.DataSourceInstanceSettings, config *configArgs, host string) string {
+	password := settings.DecryptedSecureJSONData["password"]
+	parameters := url.Values{"tlsmode": {config.driverTLSMode()}}
+	for key, value := range config.ConnectionParameters {
+		parameters.Set(key, value)
+	}
+	connURL := url.URL{
+		Scheme:   "vertica",
+		User:     url.UserPassword(settings.User, password),
+		Host:     host,
+		Path:     "/" + settings.Database,
+		RawQuery: parameters.Encode(),
+	}
+	return connURL.String()
+}
+
+// isTLSError reports whether err comes from setting up TLS with the server.
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return strings.Contains(err.Error(), "SSL/TLS") || errors.As(err, &recordErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// ping checks that db reaches the server. The driver dials without a timeout,
+// so a host dropping packets would block the ping for minutes: ping gives up
+// after timeout and leaves the dial to fail in the background.
+func ping(ctx context.Context, db *sql.DB, host string, timeout time.Duration) error {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- db.PingContext(pingCtx)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-pingCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("could not connect to %s: timeout", host)
+	}
+}
+
+// openLock returns the lock serializing opening the connection pool of the
+// datasource instance id, a channel holding a value while locked.
+func (s *VerticaDatasource) openLock(id int64) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opening == nil {
+		s.opening = make(map[int64]chan struct{})
+	}
+	lock, ok := s.opening[id]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		s.opening[id] = lock
+	}
+	return lock
 }
 
-func (s *VerticaDatasource) getDB(ctx context.Context, pluginContext backend.PluginContext) (*sql.DB, error) {
-	db, err := openConnection(pluginContext.DataSourceInstanceSettings)
+// getDB returns the connection pool of the datasource instance, opening it on
+// first use and again when the settings of the instance changed. The pool it
+// replaces is closed once its queries finished.
+func (s *VerticaDatasource) getDB(ctx context.Context, pluginContext backend.PluginContext) (*cachedDB, error) {
+	settings := pluginContext.DataSourceInstanceSettings
+	key := settingsKey(settings)
+
+	s.mu.Lock()
+	cached, ok := s.dbs[settings.ID]
+	s.mu.Unlock()
+	if ok && cached.key == key {
+		return cached, nil
+	}
+
+	// concurrent first queries wait for the one opening the pool
+	lock := s.openLock(settings.ID)
+	select {
+	case lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() {
+		<-lock
+	}()
+	s.mu.Lock()
+	cached, ok = s.dbs[settings.ID]
+	s.mu.Unlock()
+	if ok && cached.key == key {
+		return cached, nil
+	}
+
+	config, err := loadConfigArgs(settings)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseHosts(settings.URL)
+	if err != nil {
+		return nil, err
+	}
+	// the driver knows a single host, fail over to the backup hosts here
+	var db *sql.DB
+	var host string
+	for _, host = range hosts {
+		db, err = openConnection(settings, config, host)
+		if err != nil {
+			return nil, err
+		}
+		config.configurePool(db)
+		_, err = retryTransient(ctx, func() error {
+			return ping(ctx, db, host, config.connectionTimeout())
+		})
+		if err == nil && config.Subcluster != "" {
+			err = checkSubcluster(ctx, db, host, config.Subcluster)
+		}
+		if err == nil {
+			break
+		}
+		db.Close()
+		if ctx.Err() != nil {
+			break
+		}
+		log.DefaultLogger.Warn("Connecting to host failed", "datasource", settings.Name, "host", host, "error", err)
+	}
 	if err != nil {
+		if isSessionLimitError(err) {
+			return nil, sessionLimitError(err, config)
+		}
+		if config.driverTLSMode() != tlsModeNone && isTLSError(err) {
+			return nil, fmt.Errorf("TLS connection with tlsmode %s failed: %v", config.driverTLSMode(), err)
+		}
 		return nil, err
 	}
-	if err := db.PingContext(ctx); err != nil {
+	if config.TLSSkipVerify {
+		log.DefaultLogger.Warn("TLS certificate verification is disabled", "datasource", settings.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.dbs[settings.ID]; ok {
+		// close waits for the queries in flight, don't block this one meanwhile
+		go cached.close(disposeTimeout)
+	}
+	if s.dbs == nil {
+		s.dbs = make(map[int64]*cachedDB)
+	}
+	// the control session connects on first use
+	control, err := openConnection(settings, config, host)
+	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	return db, nil
+	control.SetMaxOpenConns(1)
+	control.SetMaxIdleConns(1)
+	control.SetConnMaxLifetime(time.Duration(config.ConnMaxLifetimeSeconds) * time.Second)
+	cached = &cachedDB{db: db, key: key, host: host, control: control, queries: make(chan struct{}, config.MaxConcurrentQueries)}
+	s.dbs[settings.ID] = cached
+	if config.MinIdleConnections > 1 {
+		go warmUp(db, config.MinIdleConnections, config.connectionTimeout(), settings.Name)
+	}
+	return cached, nil
+}
+
+// warmUp opens connections in db until it holds count idle ones, so the
+// queries following the first one of a new pool don't wait for connecting.
+// A connection failing to open is only logged, the pool then connects lazily.
+func warmUp(db *sql.DB, count int, timeout time.Duration, datasourceName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// hold the connections until all are open, a released one would be reused
+	conns := make([]*sql.Conn, 0, count)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for len(conns) < count {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			log.DefaultLogger.Warn("Warming up the connection pool failed", "datasource", datasourceName, "connections", len(conns), "error", err)
+			return
+		}
+		conns = append(conns, conn)
+	}
+}
+
+// checkSubcluster checks that the sessions of db, connected to host, run on
+// a node of subcluster. The driver can't ask the server to route sessions, a
+// host on another subcluster is skipped instead.
+func checkSubcluster(ctx context.Context, db *sql.DB, host string, subcluster string) error {
+	var node, actual string
+	err := db.QueryRowContext(ctx, "SELECT node_name, subcluster_name FROM v_catalog.subclusters "+
+		"WHERE node_name = (SELECT node_name FROM v_monitor.current_session)").Scan(&node, &actual)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("host %s is not on a subcluster, expected subcluster %s", host, subcluster)
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, subcluster) {
+		return fmt.Errorf("host %s (node %s) is on subcluster %s, expected subcluster %s", host, node, actual, subcluster)
+	}
+	return nil
+}
+
+// invalidate drops the cached connection pool of the datasource instance id
+// unless it was replaced already, the next query opens a new one. The pool is
+// closed once its queries finished.
+func (s *VerticaDatasource) invalidate(id int64, cached *cachedDB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dbs[id] == cached {
+		delete(s.dbs, id)
+		go cached.close(disposeTimeout)
+	}
+}
+
+// disposeTimeout bounds waiting for the queries in flight before a connection
+// pool is closed.
+const disposeTimeout = 5 * time.Second
+
+// dispose closes the connection pools of all datasource instances, waiting at
+// most disposeTimeout for their queries in flight, and logs how many sessions
+// it closed. The pools are taken out of s first, so queries and health checks
+// are not blocked on s.mu while the pools drain.
+func (s *VerticaDatasource) dispose() {
+	s.mu.Lock()
+	dbs := s.dbs
+	s.dbs = nil
+	s.mu.Unlock()
+	if len(dbs) == 0 {
+		return
+	}
+
+	sessions := 0
+	var running int64
+	var wg sync.WaitGroup
+	for _, cached := range dbs {
+		sessions += cached.db.Stats().OpenConnections
+		wg.Add(1)
+		go func(cached *cachedDB) {
+			defer wg.Done()
+			atomic.AddInt64(&running, int64(cached.close(disposeTimeout)))
+		}(cached)
+	}
+	wg.Wait()
+
+	if running > 0 {
+		log.DefaultLogger.Warn("Closed connection pools with queries in flight", "sessions", sessions, "queries", running)
+		return
+	}
+	log.DefaultLogger.Info("Closed connection pools", "sessions", sessions)
 }
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestSessionTimezone(t *testing.T) {
+	timeRange := backend.TimeRange{
+		From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		dashboard  string
+		override   string
+		want       string
+		wantNotice bool
+		wantErr    bool
+	}{
+		{dashboard: "", want: ""},
+		{dashboard: "browser", want: ""},
+		{dashboard: "utc", want: "UTC"},
+		{dashboard: "Europe/Berlin", want: "Europe/Berlin"},
+		{dashboard: "America/New_York", want: "America/New_York"},
+		{dashboard: "Asia/Kolkata", want: "", wantNotice: true},
+		{dashboard: "Asia/Kathmandu", want: "", wantNotice: true},
+		{dashboard: "Australia/Adelaide", want: "", wantNotice: true},
+		{dashboard: "America/St_Johns", want: "", wantNotice: true},
+		{dashboard: "Asia/Kolkata", override: "UTC", want: "UTC"},
+		{dashboard: "UTC", override: "Asia/Kolkata", want: "", wantNotice: true},
+		{dashboard: "Mars/Olympus", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, notice, err := sessionTimezone(queryModel{Timezone: tt.dashboard}, &configArgs{Timezone: tt.override}, timeRange)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", tt.dashboard, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.dashboard, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.dashboard, got, tt.want)
+		}
+		if (notice != "") != tt.wantNotice {
+			t.Errorf("%s/%s: notice %q", tt.dashboard, tt.override, notice)
+		}
+	}
+}
+
+func TestConnectionURLRoundTrip(t *testing.T) {
+	tests := []struct {
+		user     string
+		password string
+		database string
+	}{
+		{user: "dbadmin", password: "secret", database: "VMart"},
+		{user: "dbadmin", password: "", database: "VMart"},
+		{user: "db@admin", password: "p@ss:w/rd", database: "VMart"},
+		{user: "us:er", password: `%41%zz\`, database: "VMart"},
+		{user: `do\main\user`, password: "a b?c#d&e=f", database: "my db/x?y"},
+		{user: "user%", password: "@:/%\\", database: "%"},
+	}
+	config := &configArgs{ConnectionParameters: map[string]string{"client_label": "a&b=c"}}
+	for _, tt := range tests {
+		settings := &backend.DataSourceInstanceSettings{
+			User:                    tt.user,
+			Database:                tt.database,
+			DecryptedSecureJSONData: map[string]string{"password": tt.password},
+		}
+		dsn := connectionURL(settings, config, "[::1]:5433")
+		parsed, err := url.Parse(dsn)
+		if err != nil {
+			t.Errorf("%s: %v", dsn, err)
+			continue
+		}
+		if got := parsed.User.Username(); got != tt.user {
+			t.Errorf("%s: user %q, want %q", dsn, got, tt.user)
+		}
+		if got, _ := parsed.User.Password(); got != tt.password {
+			t.Errorf("%s: password %q, want %q", dsn, got, tt.password)
+		}
+		if got := parsed.Path[1:]; got != tt.database {
+			t.Errorf("%s: database %q, want %q", dsn, got, tt.database)
+		}
+		if got := parsed.Host; got != "[::1]:5433" {
+			t.Errorf("%s: host %q", dsn, got)
+		}
+		if got := parsed.Query().Get("client_label"); got != "a&b=c" {
+			t.Errorf("%s: client_label %q", dsn, got)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "db1", want: "db1:5433"},
+		{host: "db1:5434", want: "db1:5434"},
+		{host: "192.168.0.1", want: "192.168.0.1:5433"},
+		{host: "vertica://db1:5434", want: "db1:5434"},
+		{host: "VERTICA://db1/", want: "db1:5433"},
+		{host: "Vertica://[::1]:5434/", want: "[::1]:5434"},
+		{host: "::1", want: "[::1]:5433"},
+		{host: "[::1]", want: "[::1]:5433"},
+		{host: "[::1]:5434", want: "[::1]:5434"},
+		{host: "2001:db8::1", want: "[2001:db8::1]:5433"},
+		// without brackets the last group is part of the address, not a port
+		{host: "fe80::1:5434", want: "[fe80::1:5434]:5433"},
+		{host: "", wantErr: true},
+		{host: "vertica://", wantErr: true},
+		{host: "db1:", wantErr: true},
+		{host: "db1:0", wantErr: true},
+		{host: "db1:65536", wantErr: true},
+		{host: "db1:port", wantErr: true},
+		{host: "[::1]:", wantErr: true},
+		{host: "[::1", wantErr: true},
+		{host: "dbadmin@db1", wantErr: true},
+		{host: "db1/VMart", wantErr: true},
+		{host: "http://db1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeHost(tt.host)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.host, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.host, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		hosts   string
+		want    []string
+		wantErr bool
+	}{
+		{hosts: "db1", want: []string{"db1:5433"}},
+		{hosts: "db1, db2:5434", want: []string{"db1:5433", "db2:5434"}},
+		{hosts: "db1,", want: []string{"db1:5433"}},
+		{hosts: "db1, ,db2", want: []string{"db1:5433", "db2:5433"}},
+		{hosts: "[::1]:5434,::2,vertica://db3", want: []string{"[::1]:5434", "[::2]:5433", "db3:5433"}},
+		{hosts: "", wantErr: true},
+		{hosts: " , ", wantErr: true},
+		{hosts: "db1,db2:port", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseHosts(tt.hosts)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.hosts, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.hosts, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.hosts, got, tt.want)
+		}
+	}
+}
+
+func TestBuildTableQueryResultBareNull(t *testing.T) {
+	// SELECT NULL AS nothing, 1 AS one: the driver knows no type for the NULL
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := fakeResult{
+		columns: []fakeColumn{
+			{name: "nothing", typeName: "unknown column type oid: 0"},
+			{name: "one", typeName: "integer"},
+		},
+		rows: [][]driver.Value{{nil, int64(1)}, {nil, nil}},
+	}
+	frame, err := (&VerticaDatasource{}).buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Rows() != 2 {
+		t.Fatalf("got %d rows, want 2", frame.Rows())
+	}
+	if got := frame.Fields[0].Type(); got != data.FieldTypeNullableString {
+		t.Errorf("NULL column type %v, want %v", got, data.FieldTypeNullableString)
+	}
+	for row := 0; row < 2; row++ {
+		if got := frame.Fields[0].At(row).(*string); got != nil {
+			t.Errorf("row %d: got %q, want NULL", row, *got)
+		}
+	}
+	if got := frame.Fields[1].At(1).(*float64); got != nil {
+		t.Errorf("NULL integer: got %v, want NULL", *got)
+	}
+	unknown, ok := frame.Meta.Custom["unknownTypes"].([]*unknownType)
+	if !ok || len(unknown) != 1 || unknown[0].Column != "nothing" {
+		t.Errorf("unknownTypes: got %v", frame.Meta.Custom["unknownTypes"])
+	}
+}
+
+func TestNumberWidths(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 0)
+	timeRange := backend.TimeRange{From: at, To: at.Add(time.Hour)}
+	tests := []struct {
+		typeName string
+		value    driver.Value
+		want     float64
+	}{
+		{typeName: "integer", value: int(-42), want: -42},
+		{typeName: "integer", value: int8(-42), want: -42},
+		{typeName: "integer", value: int16(-42), want: -42},
+		{typeName: "integer", value: int32(-42), want: -42},
+		{typeName: "integer", value: int64(-42), want: -42},
+		{typeName: "integer", value: uint(42), want: 42},
+		{typeName: "integer", value: uint8(42), want: 42},
+		{typeName: "integer", value: uint16(42), want: 42},
+		{typeName: "integer", value: uint32(42), want: 42},
+		{typeName: "integer", value: uint64(42), want: 42},
+		{typeName: "integer", value: uint64(math.MaxInt64), want: math.MaxInt64},
+		{typeName: "integer", value: uint64(math.MaxUint64), want: math.MaxUint64},
+		{typeName: "integer", value: "42", want: 42},
+		{typeName: "float", value: float32(1.5), want: 1.5},
+		{typeName: "float", value: float64(1.5), want: 1.5},
+	}
+	for _, tt := range tests {
+		result := fakeResult{
+			columns: []fakeColumn{{name: "time", typeName: "timestamp"}, {name: "value", typeName: tt.typeName}},
+			rows:    [][]driver.Value{{at, tt.value}},
+		}
+
+		frame, err := (&VerticaDatasource{}).buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+		if err != nil {
+			t.Errorf("table %T: %v", tt.value, err)
+		} else if got, ok := frame.Fields[1].At(0).(*float64); !ok || got == nil || *got != tt.want {
+			t.Errorf("table %T: got %v, want %v", tt.value, frame.Fields[1].At(0), tt.want)
+		}
+
+		frames := buildFakeTimeSeries(t, result, queryModel{}, timeRange)
+		if got, ok := frames[0].Fields[1].At(0).(*float64); !ok || got == nil || *got != tt.want {
+			t.Errorf("time series %T: got %v, want %v", tt.value, frames[0].Fields[1].At(0), tt.want)
+		}
+	}
+}
+
+func TestBuildFieldsDecimals(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake driver reports precision and scale, the pinned one never does
+	// and leaves every column like unscaled
+	result := fakeResult{columns: []fakeColumn{
+		{name: "amount", typeName: "numeric", precision: 38, scale: 10},
+		{name: "whole", typeName: "numeric", precision: 10, scale: 0},
+		{name: "ratio__percent", typeName: "numeric", precision: 5, scale: 2},
+		{name: "reading", typeName: "float"},
+		{name: "label", typeName: "varchar", precision: 20, scale: 4},
+		{name: "unscaled", typeName: "numeric"},
+	}}
+	fields, _, err := buildFields(queryFake(t, &fakeConnector{result: result}), newFieldOptions(config, queryModel{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		decimals int
+		unit     string
+	}{
+		{name: "amount", decimals: 10},
+		{name: "whole", decimals: 0},
+		{name: "ratio", decimals: 2, unit: "percent"},
+		{name: "reading", decimals: -1},
+		{name: "label", decimals: -1},
+		{name: "unscaled", decimals: -1},
+	}
+	for i, tt := range tests {
+		field := fields[i]
+		if field.Name != tt.name {
+			t.Errorf("field %d: name %q, want %q", i, field.Name, tt.name)
+		}
+		if tt.decimals < 0 {
+			if field.Config != nil && field.Config.Decimals != nil {
+				t.Errorf("%s: decimals %d, want none", tt.name, *field.Config.Decimals)
+			}
+			continue
+		}
+		if field.Config == nil || field.Config.Decimals == nil || int(*field.Config.Decimals) != tt.decimals {
+			t.Errorf("%s: config %+v, want %d decimals", tt.name, field.Config, tt.decimals)
+			continue
+		}
+		if field.Config.Unit != tt.unit {
+			t.Errorf("%s: unit %q, want %q", tt.name, field.Config.Unit, tt.unit)
+		}
+	}
+
+	// series keep the decimals of their value column
+	series := &timeSeries{name: "amount", config: fieldConfig(fields[0])}
+	if decimals := series.toFrame().Fields[1].Config.Decimals; decimals == nil || *decimals != 10 {
+		t.Errorf("series decimals: got %v, want 10", decimals)
+	}
+}
+
+func TestColumnsMeta(t *testing.T) {
+	result := fakeResult{columns: []fakeColumn{
+		{name: "d", typeName: dateType},
+		{name: "t", typeName: timeType},
+		{name: "ttz", typeName: timeTZType},
+		{name: "ds", typeName: intervalDayToSecondType},
+		{name: "ym", typeName: intervalYearToMonthType},
+		{name: "n", typeName: "integer"},
+		{name: "x", typeName: "unknown column type oid: 1234"},
+	}}
+	want := []string{"date", "time", "timetz", "interval day to second", "interval year to month", "integer", "unknown column type oid: 1234"}
+	columns := columnsMeta(fakeColumnTypes(t, result), nil)
+	for i, column := range columns {
+		if column.Name != result.columns[i].name || column.VerticaType != want[i] {
+			t.Errorf("column %d: got %s %q, want %s %q", i, column.Name, column.VerticaType, result.columns[i].name, want[i])
+		}
+	}
+}
+
+func TestTimestampZones(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	est, edt := time.FixedZone("", -5*3600), time.FixedZone("", -4*3600)
+	// The driver reads naive TIMESTAMP values as wall clock times in UTC and
+	// TIMESTAMPTZ values with their offset. DST starts at 2:00 on March 10.
+	result := fakeResult{
+		columns: []fakeColumn{{name: "naive", typeName: "timestamp"}, {name: "zoned", typeName: "timestamptz"}},
+		rows: [][]driver.Value{
+			{time.Date(2024, 3, 10, 1, 30, 0, 0, time.UTC), time.Date(2024, 3, 10, 1, 30, 0, 0, est)},
+			{time.Date(2024, 3, 10, 3, 30, 0, 0, time.UTC), time.Date(2024, 3, 10, 3, 30, 0, 0, edt)},
+		},
+	}
+	tests := []struct {
+		timestampZone string
+		want          []time.Time
+	}{
+		{
+			timestampZone: "",
+			want:          []time.Time{time.Date(2024, 3, 10, 1, 30, 0, 0, time.UTC), time.Date(2024, 3, 10, 3, 30, 0, 0, time.UTC)},
+		},
+		{
+			timestampZone: "server",
+			want:          []time.Time{time.Date(2024, 3, 10, 1, 30, 0, 0, time.UTC), time.Date(2024, 3, 10, 3, 30, 0, 0, time.UTC)},
+		},
+		{
+			timestampZone: "UTC",
+			want:          []time.Time{time.Date(2024, 3, 10, 1, 30, 0, 0, time.UTC), time.Date(2024, 3, 10, 3, 30, 0, 0, time.UTC)},
+		},
+		{
+			// an hour apart on the wall clock, an hour apart in time as well
+			timestampZone: "America/New_York",
+			want:          []time.Time{time.Date(2024, 3, 10, 1, 30, 0, 0, newYork), time.Date(2024, 3, 10, 3, 30, 0, 0, newYork)},
+		},
+	}
+	for _, tt := range tests {
+		config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{"timestampZone":"` + tt.timestampZone + `"}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := (&VerticaDatasource{}).buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for row := range result.rows {
+			if got, ok := frame.Fields[0].At(row).(*time.Time); !ok || got == nil || !got.Equal(tt.want[row]) {
+				t.Errorf("%q: TIMESTAMP row %d: got %v, want %v", tt.timestampZone, row, frame.Fields[0].At(row), tt.want[row])
+			}
+			// TIMESTAMPTZ values keep their offset whatever the setting
+			zoned := result.rows[row][1].(time.Time)
+			if got, ok := frame.Fields[1].At(row).(*time.Time); !ok || got == nil || !got.Equal(zoned) {
+				t.Errorf("%q: TIMESTAMPTZ row %d: got %v, want %v", tt.timestampZone, row, frame.Fields[1].At(row), zoned)
+			}
+		}
+	}
+
+	if _, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{"timestampZone":"Mars/Olympus"}`)}); err == nil {
+		t.Error("invalid timestampZone accepted")
+	}
+}
+
+func TestDuplicateColumnNames(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// SELECT a.time, a.id, b.id, c.id, d.id_2 FROM ...
+	result := fakeResult{
+		columns: []fakeColumn{
+			{name: "time", typeName: "timestamp"},
+			{name: "id", typeName: "integer"},
+			{name: "id", typeName: "integer"},
+			{name: "id_2", typeName: "integer"},
+			{name: "id", typeName: "integer"},
+		},
+		rows: [][]driver.Value{{start, int64(1), int64(2), int64(3), int64(4)}},
+	}
+	wantNames := []string{"time", "id", "id_3", "id_2", "id_4"}
+	wantRenamed := map[string]string{"id_3": "id", "id_4": "id"}
+
+	for run := 0; run < 2; run++ {
+		frame, err := (&VerticaDatasource{}).buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range wantNames {
+			if got := frame.Fields[i].Name; got != want {
+				t.Errorf("table column %d named %s, want %s", i, got, want)
+			}
+			if i > 0 {
+				if got := frame.Fields[i].At(0).(*float64); *got != float64(i) {
+					t.Errorf("table column %s holds %v, want %d", wantNames[i], *got, i)
+				}
+			}
+		}
+		if got := frame.Meta.Custom["renamedColumns"]; !reflect.DeepEqual(got, wantRenamed) {
+			t.Errorf("renamedColumns: got %v, want %v", got, wantRenamed)
+		}
+	}
+
+	// the series are named after the renamed columns
+	frames := buildFakeTimeSeries(t, result, queryModel{ValueColumns: []string{"id_3", "id_4"}}, backend.TimeRange{From: start, To: start.Add(time.Hour)})
+	if len(frames) != 2 || frames[0].Fields[1].Name != "id_3" || frames[1].Fields[1].Name != "id_4" {
+		t.Fatalf("got series %v", frames)
+	}
+	if got := frameValues(t, frames[1]); !sameValues(got, []float64{4}) {
+		t.Errorf("id_4: got %v, want [4]", got)
+	}
+	if got := frames[0].Meta.Custom["renamedColumns"]; !reflect.DeepEqual(got, wantRenamed) {
+		t.Errorf("time series renamedColumns: got %v, want %v", got, wantRenamed)
+	}
+}
+
+func TestGetDBPasswordRotation(t *testing.T) {
+	var opened []string
+	defer func(open func(string, string) (*sql.DB, error)) { sqlOpen = open }(sqlOpen)
+	sqlOpen = func(_ string, dsn string) (*sql.DB, error) {
+		opened = append(opened, dsn)
+		return sql.OpenDB(&fakeConnector{}), nil
+	}
+	password := func(dsn string) string {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := u.User.Password()
+		return p
+	}
+
+	v := &VerticaDatasource{}
+	defer v.dispose()
+	settings := &backend.DataSourceInstanceSettings{
+		ID:                      1,
+		URL:                     "vertica.example.com:5433",
+		User:                    "dbadmin",
+		Database:                "VMart",
+		JSONData:                []byte(`{}`),
+		DecryptedSecureJSONData: map[string]string{"password": "old"},
+	}
+	ctx := context.Background()
+	first, err := v.getDB(ctx, backend.PluginContext{DataSourceInstanceSettings: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := v.getDB(ctx, backend.PluginContext{DataSourceInstanceSettings: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Error("unchanged settings opened a new pool")
+	}
+
+	// the password is rotated: the next query gets a pool with the new one
+	rotated := *settings
+	rotated.DecryptedSecureJSONData = map[string]string{"password": "new"}
+	second, err := v.getDB(ctx, backend.PluginContext{DataSourceInstanceSettings: &rotated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("rotated password kept the old pool")
+	}
+	// a pool and its control session per settings
+	if len(opened) != 4 {
+		t.Fatalf("opened %d pools, want 4", len(opened))
+	}
+	for i, want := range []string{"old", "old", "new", "new"} {
+		if got := password(opened[i]); got != want {
+			t.Errorf("pool %d opened with password %q, want %q", i, got, want)
+		}
+	}
+	// the old pool is closed in the background
+	for deadline := time.Now().Add(time.Second); first.db.Ping() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Error("old pool not closed")
+			break
+		}
+	}
+	if err := second.db.Ping(); err != nil {
+		t.Errorf("new pool: %v", err)
+	}
+}
+
+func TestQueryDataConcurrent(t *testing.T) {
+	connector := &fakeConnector{
+		result: fakeResult{columns: []fakeColumn{{name: "slept", typeName: "integer"}}, rows: [][]driver.Value{{int64(1)}}},
+		results: map[string]fakeResult{
+			"SELECT CURRENT_SESSION()": {columns: []fakeColumn{{name: "session", typeName: "varchar"}}, rows: [][]driver.Value{{"v_vmart_node0001-1:0x1"}}},
+		},
+		delays: map[string]time.Duration{"SELECT SLEEP(1)": time.Second},
+		fail: func(query string) error {
+			if query == "SELECT broken" {
+				return errors.New("syntax error")
+			}
+			return nil
+		},
+	}
+	defer func(open func(string, string) (*sql.DB, error)) { sqlOpen = open }(sqlOpen)
+	sqlOpen = func(string, string) (*sql.DB, error) {
+		return sql.OpenDB(connector), nil
+	}
+
+	v := &VerticaDatasource{}
+	defer v.dispose()
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			ID:       1,
+			URL:      "vertica.example.com:5433",
+			JSONData: []byte(`{}`),
+		}},
+	}
+	for _, query := range []struct{ refID, sql string }{{"A", "SELECT SLEEP(1)"}, {"B", "SELECT SLEEP(1)"}, {"C", "SELECT broken"}} {
+		req.Queries = append(req.Queries, backend.DataQuery{
+			RefID: query.refID,
+			JSON:  []byte(`{"rawSql":"` + query.sql + `","format":"table"}`),
+		})
+	}
+
+	start := time.Now()
+	response, err := v.QueryData(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("two 1 second queries took %v", elapsed)
+	}
+	for _, refID := range []string{"A", "B"} {
+		r := response.Responses[refID]
+		if r.Error != nil {
+			t.Errorf("%s: unexpected error: %v", refID, r.Error)
+			continue
+		}
+		if len(r.Frames) != 1 || r.Frames[0].Rows() != 1 {
+			t.Errorf("%s: got frames %v", refID, r.Frames)
+		}
+	}
+	if r := response.Responses["C"]; r.Error == nil {
+		t.Error("C: expected an error")
+	}
+}
+
+func TestCachedDBClose(t *testing.T) {
+	open := func() *cachedDB {
+		return &cachedDB{
+			db:      sql.OpenDB(&fakeConnector{}),
+			control: sql.OpenDB(&fakeConnector{}),
+			queries: make(chan struct{}, 2),
+		}
+	}
+
+	// close waits for the query in flight
+	cached := open()
+	release, err := cached.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := make(chan int)
+	go func() {
+		running <- cached.close(time.Minute)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := cached.db.Ping(); err != nil {
+		t.Fatalf("pool closed with a query in flight: %v", err)
+	}
+	release()
+	if n := <-running; n != 0 {
+		t.Errorf("closed with %d queries running, want 0", n)
+	}
+	if err := cached.db.Ping(); err == nil {
+		t.Error("pool not closed")
+	}
+	if len(cached.queries) != 0 {
+		t.Errorf("close kept %d query slots", len(cached.queries))
+	}
+
+	// and gives up after timeout
+	cached = open()
+	if _, err := cached.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := cached.close(50 * time.Millisecond); n != 1 {
+		t.Errorf("closed with %d queries running, want 1", n)
+	}
+	if err := cached.db.Ping(); err == nil {
+		t.Error("pool not closed after the timeout")
+	}
+}
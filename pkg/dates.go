@@ -0,0 +1,102 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The driver does not name date types, it reports them by type OID.
+const dateType = "unknown column type oid: 10"
+
+const (
+	timeType   = "unknown column type oid: 11"
+	timeTZType = "unknown column type oid: 15"
+)
+
+const dateLayout = "2006-01-02"
+
+var timeOfDayPattern = regexp.MustCompile(`^(\d{2}:\d{2}:\d{2})(?:\.(\d{1,6}))?(.*)$`)
+
+// formatTimeOfDay renders a TIME or TIMETZ value as HH:MM:SS.ffffff, followed
+// by the offset of a TIMETZ value.
+func formatTimeOfDay(value string) string {
+	match := timeOfDayPattern.FindStringSubmatch(value)
+	if match == nil {
+		return value
+	}
+	return match[1] + "." + match[2] + strings.Repeat("0", 6-len(match[2])) + match[3]
+}
+
+// timeOfDayColumns returns the indexes of the TIME and TIMETZ columns among
+// colTypes. Lacking a date, they never hold the time axis.
+func timeOfDayColumns(colTypes []*sql.ColumnType) map[int]bool {
+	columns := make(map[int]bool)
+	for i, colType := range colTypes {
+		if name := colType.DatabaseTypeName(); name == timeType || name == timeTZType {
+			columns[i] = true
+		}
+	}
+	return columns
+}
+
+// parseDate parses a DATE value as midnight UTC, so dates do not depend on
+// the timezone of the server or the session.
+func parseDate(value string) (time.Time, bool) {
+	t, err := time.ParseInLocation(dateLayout, value, time.UTC)
+	return t, err == nil
+}
+
+// formatDateColumns turns the DATE columns of frame, described by colTypes,
+// into columns of ISO dates.
+func formatDateColumns(frame *data.Frame, colTypes []*sql.ColumnType) {
+	for i, colType := range colTypes {
+		if colType.DatabaseTypeName() != dateType || i >= len(frame.Fields) {
+			continue
+		}
+		field := frame.Fields[i]
+		values := make([]*string, field.Len())
+		for row := range values {
+			if t, ok := field.At(row).(*time.Time); ok && t != nil {
+				str := t.Format(dateLayout)
+				values[row] = &str
+			}
+		}
+		frame.Fields[i] = data.NewField(field.Name, field.Labels, values)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestDateColumns(t *testing.T) {
+	// the days around the start of DST in Europe and in the US
+	dates := []string{"2024-03-09", "2024-03-10", "2024-03-11", "2024-03-30", "2024-03-31", "2024-04-01"}
+	result := fakeResult{columns: []fakeColumn{{name: "day", typeName: dateType}, {name: "orders", typeName: "integer"}}}
+	for i, date := range dates {
+		result.rows = append(result.rows, []driver.Value{date, int64(i)})
+	}
+
+	// tables show the ISO date
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{"timestampZone":"America/New_York"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := (&VerticaDatasource{}).buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row, want := range dates {
+		if got, ok := frame.Fields[0].At(row).(*string); !ok || got == nil || *got != want {
+			t.Errorf("table row %d: got %v, want %s", row, frame.Fields[0].At(row), want)
+		}
+	}
+
+	// time series put every date at midnight UTC, so the days across DST
+	// stay 24 hours apart
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	frames := buildFakeTimeSeries(t, result, queryModel{}, backend.TimeRange{From: from, To: from.AddDate(0, 1, 1)})
+	times := frameTimes(t, frames[0])
+	if len(times) != len(dates) {
+		t.Fatalf("got %v, want %d times", times, len(dates))
+	}
+	for i, date := range dates {
+		want, err := time.Parse(dateLayout, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !times[i].Equal(want) || times[i].Location() != time.UTC {
+			t.Errorf("time series point %d at %v, want %v", i, times[i], want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	downsampleAvg  = "avg"
+	downsampleMin  = "min"
+	downsampleMax  = "max"
+	downsampleLast = "last"
+)
+
+// parseDownsampleAggregation normalizes the aggregation used when downsampling.
+func parseDownsampleAggregation(aggregation string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(aggregation)) {
+	case "", downsampleAvg:
+		return downsampleAvg, nil
+	case downsampleMin:
+		return downsampleMin, nil
+	case downsampleMax:
+		return downsampleMax, nil
+	case downsampleLast:
+		return downsampleLast, nil
+	default:
+		return "", fmt.Errorf("unsupported downsample aggregation: %s", aggregation)
+	}
+}
+
+// downsampleBucket returns the bucket width that keeps a series spanning
+// timeRange within maxDataPoints, but never narrower than interval.
+func downsampleBucket(timeRange backend.TimeRange, interval time.Duration, maxDataPoints int64) time.Duration {
+	bucket := interval
+	if maxDataPoints > 0 {
+		if width := timeRange.To.Sub(timeRange.From) / time.Duration(maxDataPoints); width > bucket {
+			bucket = width
+		}
+	}
+	return bucket
+}
+
+// downsample aggregates the points of s into buckets of the given width when s
+// has more than maxDataPoints points. NULL values are ignored by the
+// aggregation and a bucket with only NULL values stays NULL. It returns whether
+// the series was downsampled. Points are expected to be ordered by time.
+func (s *timeSeries) downsample(aggregation string, bucket time.Duration, maxDataPoints int64) bool {
+	if maxDataPoints <= 0 || int64(len(s.times)) <= maxDataPoints || bucket <= 0 {
+		return false
+	}
+
+	var times []time.Time
+	var values []*float64
+
+	var current time.Time
+	var acc float64
+	var count int
+	flush := func() {
+		if count == 0 {
+			values = append(values, nil)
+			return
+		}
+		v := acc
+		if aggregation == downsampleAvg {
+			v = acc / float64(count)
+		}
+		values = append(values, &v)
+	}
+
+	for i, t := range s.times {
+		start := alignDown(t, bucket)
+		if len(times) == 0 || !start.Equal(current) {
+			if len(times) > 0 {
+				flush()
+			}
+			times = append(times, start)
+			current = start
+			acc, count = 0, 0
+		}
+
+		value := s.values[i]
+		if value == nil {
+			continue
+		}
+		switch {
+		case count == 0:
+			acc = *value
+		case aggregation == downsampleMin:
+			acc = math.Min(acc, *value)
+		case aggregation == downsampleMax:
+			acc = math.Max(acc, *value)
+		case aggregation == downsampleLast:
+			acc = *value
+		default:
+			acc += *value
+		}
+		count++
+	}
+	if len(times) > 0 {
+		flush()
+	}
+
+	s.times = times
+	s.values = values
+	return true
+}
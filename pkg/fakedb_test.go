@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeColumn describes a column of a fakeResult the way the Vertica driver
+// does. A precision of zero leaves the precision and scale unreported, as the
+// pinned driver never reports them.
+type fakeColumn struct {
+	name      string
+	typeName  string
+	precision int64
+	scale     int64
+}
+
+// fakeResult is what every query against a fakeConnector returns.
+type fakeResult struct {
+	columns []fakeColumn
+	rows    [][]driver.Value
+}
+
+// fakeConnector is a database/sql connector whose queries all return result
+// and are recorded in queries, so tests can build the *sql.Rows and
+// *sql.ColumnType values the result builders read. Queries fail returns an
+// error for fail instead. The queries in results return their own result,
+// after the delay set for them.
+type fakeConnector struct {
+	result  fakeResult
+	fail    func(query string) error
+	results map[string]fakeResult
+	delays  map[string]time.Duration
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) { return &fakeConn{c}, nil }
+func (c *fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return nil, errors.New("use the connector") }
+
+type fakeConn struct{ connector *fakeConnector }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.connector.mu.Lock()
+	c.connector.queries = append(c.connector.queries, query)
+	c.connector.mu.Unlock()
+	if c.connector.fail != nil {
+		if err := c.connector.fail(query); err != nil {
+			return nil, err
+		}
+	}
+	select {
+	case <-time.After(c.connector.delays[query]):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if result, ok := c.connector.results[query]; ok {
+		return &fakeRows{result: result}, nil
+	}
+	return &fakeRows{result: c.connector.result}, nil
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string {
+	names := make([]string, len(r.result.columns))
+	for i, column := range r.result.columns {
+		names[i] = column.name
+	}
+	return names
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.result.columns[index].typeName
+}
+
+func (r *fakeRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	column := r.result.columns[index]
+	return column.precision, column.scale, column.precision > 0
+}
+
+// queryFake runs a query against a fakeConnector returning result. The rows
+// are closed when the test ends.
+func queryFake(t *testing.T, connector *fakeConnector) *sql.Rows {
+	t.Helper()
+	db := sql.OpenDB(connector)
+	t.Cleanup(func() { db.Close() })
+	rows, err := db.Query("SELECT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rows.Close() })
+	return rows
+}
+
+// fakeColumnTypes returns the column types of result.
+func fakeColumnTypes(t *testing.T, result fakeResult) []*sql.ColumnType {
+	t.Helper()
+	colTypes, err := queryFake(t, &fakeConnector{result: result}).ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return colTypes
+}
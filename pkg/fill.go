@@ -0,0 +1,226 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	fillModeNone     = ""
+	fillModeNull     = "null"
+	fillModeZero     = "zero"
+	fillModePrevious = "previous"
+)
+
+// parseFillMode normalizes the fill directive of a query.
+func parseFillMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "none":
+		return fillModeNone, nil
+	case "null":
+		return fillModeNull, nil
+	case "0", "zero":
+		return fillModeZero, nil
+	case "previous":
+		return fillModePrevious, nil
+	default:
+		return "", fmt.Errorf("unsupported fill mode: %s", mode)
+	}
+}
+
+// alignDown returns the interval boundary at or before t.
+func alignDown(t time.Time, interval time.Duration) time.Time {
+	ns := t.UnixNano()
+	offset := ns % int64(interval)
+	if offset < 0 {
+		offset += int64(interval)
+	}
+	return time.Unix(0, ns-offset).In(t.Location())
+}
+
+const (
+	calendarDay   = "day"
+	calendarWeek  = "week"
+	calendarMonth = "month"
+)
+
+// calendarBucket is a $__timeGroup bucket aligned to calendar days, weeks or
+// months in the session timezone instead of to multiples of a fixed width.
+type calendarBucket struct {
+	unit      string
+	weekStart time.Weekday
+	location  *time.Location
+}
+
+// floor returns the start of the bucket containing t.
+func (c *calendarBucket) floor(t time.Time) time.Time {
+	t = t.In(c.location)
+	switch c.unit {
+	case calendarMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, c.location)
+	case calendarWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.location)
+		return day.AddDate(0, 0, -int((7+t.Weekday()-c.weekStart)%7))
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.location)
+	}
+}
+
+// next returns the start of the bucket following the one starting at t. Days
+// across a DST transition and months are not of a fixed length, so the step
+// is taken on the calendar.
+func (c *calendarBucket) next(t time.Time) time.Time {
+	switch c.unit {
+	case calendarMonth:
+		return t.AddDate(0, 1, 0)
+	case calendarWeek:
+		return t.AddDate(0, 0, 7)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// maxFillPoints bounds the points fill inserts into a series, a small bucket
+// over a long time range would otherwise build a huge series.
+const maxFillPoints = 100000
+
+// fill inserts points at the start of every interval bucket of timeRange that
+// has no point in s. Points need not be aligned to the buckets, a bucket with
+// any point in it is left alone. The inserted value depends on mode. Points
+// are expected to be ordered by time. Boundaries are shifted by offset. A
+// non-nil calendar replaces interval by calendar aligned buckets. At most
+// maxFillPoints are inserted, fill reports whether buckets were left empty
+// because of it.
+func (s *timeSeries) fill(mode string, timeRange backend.TimeRange, interval time.Duration, offset time.Duration, calendar *calendarBucket) bool {
+	if mode == fillModeNone || interval <= 0 {
+		return false
+	}
+
+	floor := func(t time.Time) time.Time { return alignDown(t.Add(-offset), interval).Add(offset) }
+	step := func(t time.Time) time.Time { return t.Add(interval) }
+	if calendar != nil {
+		floor, step = calendar.floor, calendar.next
+	}
+
+	var prev *float64
+	fillValue := func() *float64 {
+		switch mode {
+		case fillModeZero:
+			zero := 0.0
+			return &zero
+		case fillModePrevious:
+			return prev
+		default:
+			return nil
+		}
+	}
+
+	times := make([]time.Time, 0, len(s.times))
+	values := make([]*float64, 0, len(s.values))
+	next := floor(timeRange.From)
+	inserted, capped := 0, false
+	insert := func() bool {
+		if inserted == maxFillPoints {
+			capped = true
+			return false
+		}
+		times = append(times, next)
+		values = append(values, fillValue())
+		next = step(next)
+		inserted++
+		return true
+	}
+
+	for i, t := range s.times {
+		bucket := floor(t)
+		for next.Before(bucket) {
+			if !insert() {
+				break
+			}
+		}
+		times = append(times, t)
+		values = append(values, s.values[i])
+		prev = s.values[i]
+		if !next.After(t) {
+			next = step(bucket)
+		}
+	}
+	for !next.After(timeRange.To) {
+		if !insert() {
+			break
+		}
+	}
+
+	s.times = times
+	s.values = values
+	return capped
+}
+
+// markGaps inserts a NULL point one interval after every point that is followed
+// by a gap wider than threshold intervals, so the gap is not bridged when drawn.
+// The series is only reallocated when there are gaps to mark.
+func (s *timeSeries) markGaps(threshold float64, interval time.Duration) {
+	if threshold <= 0 || interval <= 0 {
+		return
+	}
+	maxGap := time.Duration(threshold * float64(interval))
+
+	gaps := 0
+	for i := 1; i < len(s.times); i++ {
+		if s.times[i].Sub(s.times[i-1]) > maxGap {
+			gaps++
+		}
+	}
+	if gaps == 0 {
+		return
+	}
+
+	times := make([]time.Time, 0, len(s.times)+gaps)
+	values := make([]*float64, 0, len(s.values)+gaps)
+	for i, t := range s.times {
+		if i > 0 && t.Sub(s.times[i-1]) > maxGap {
+			times = append(times, s.times[i-1].Add(interval))
+			values = append(values, nil)
+		}
+		times = append(times, t)
+		values = append(values, s.values[i])
+	}
+
+	s.times = times
+	s.values = values
+}
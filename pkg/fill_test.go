@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestTimeSeriesFill(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	value := func(v float64) *float64 { return &v }
+	type point struct {
+		seconds int
+		value   *float64
+	}
+	tests := []struct {
+		name   string
+		mode   string
+		offset time.Duration
+		points []point
+		want   []point
+	}{
+		{
+			name:   "aligned",
+			mode:   fillModeNull,
+			points: []point{{0, value(1)}, {120, value(3)}},
+			want:   []point{{0, value(1)}, {60, nil}, {120, value(3)}, {180, nil}, {240, nil}},
+		},
+		{
+			name:   "unaligned",
+			mode:   fillModeNull,
+			points: []point{{30, value(1)}, {150, value(3)}, {170, value(4)}},
+			want:   []point{{30, value(1)}, {60, nil}, {150, value(3)}, {170, value(4)}, {180, nil}, {240, nil}},
+		},
+		{
+			name:   "unaligned previous",
+			mode:   fillModePrevious,
+			points: []point{{59, value(1)}, {61, value(2)}, {239, value(3)}},
+			want:   []point{{59, value(1)}, {61, value(2)}, {120, value(2)}, {239, value(3)}, {240, value(3)}},
+		},
+		{
+			name:   "unaligned zero",
+			mode:   fillModeZero,
+			points: []point{{90, value(1)}},
+			want:   []point{{0, value(0)}, {90, value(1)}, {120, value(0)}, {180, value(0)}, {240, value(0)}},
+		},
+		{
+			name:   "offset",
+			mode:   fillModeNull,
+			offset: 15 * time.Second,
+			points: []point{{20, value(1)}, {200, value(2)}},
+			want:   []point{{-45, nil}, {20, value(1)}, {75, nil}, {135, nil}, {200, value(2)}},
+		},
+		{
+			name:   "before the range",
+			mode:   fillModeNull,
+			points: []point{{-30, value(1)}, {10, value(2)}},
+			want:   []point{{-30, value(1)}, {10, value(2)}, {60, nil}, {120, nil}, {180, nil}, {240, nil}},
+		},
+	}
+	timeRange := backend.TimeRange{From: at(0), To: at(240)}
+	for _, tt := range tests {
+		s := &timeSeries{name: tt.name}
+		for _, p := range tt.points {
+			s.append(at(p.seconds), p.value)
+		}
+		s.fill(tt.mode, timeRange, time.Minute, tt.offset, nil)
+		if len(s.times) != len(tt.want) {
+			t.Errorf("%s: got %d points %v, want %d", tt.name, len(s.times), s.times, len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			if !s.times[i].Equal(at(want.seconds)) {
+				t.Errorf("%s: point %d at %v, want %v", tt.name, i, s.times[i], at(want.seconds))
+			}
+			if (s.values[i] == nil) != (want.value == nil) || s.values[i] != nil && *s.values[i] != *want.value {
+				t.Errorf("%s: point %d value %v, want %v", tt.name, i, s.values[i], want.value)
+			}
+		}
+	}
+}
+
+func TestTimeSeriesFillCalendar(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(d, hour int) time.Time { return time.Date(2024, 3, d, hour, 0, 0, 0, berlin) }
+	one := 1.0
+	s := &timeSeries{name: "days"}
+	// a point late on the DST day and one in the middle of the 31st
+	s.append(day(30, 23), &one)
+	s.append(day(31, 12), &one)
+	s.fill(fillModeNull, backend.TimeRange{From: day(29, 0), To: day(32, 0)}, 24*time.Hour, 0, &calendarBucket{unit: calendarDay, location: berlin})
+	want := []time.Time{day(29, 0), day(30, 23), day(31, 12), day(32, 0)}
+	if len(s.times) != len(want) {
+		t.Fatalf("got %v, want %v", s.times, want)
+	}
+	for i := range want {
+		if !s.times[i].Equal(want[i]) {
+			t.Errorf("point %d at %v, want %v", i, s.times[i], want[i])
+		}
+	}
+}
+
+func TestTimeSeriesFillLimit(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	one := 1.0
+
+	// the range holds exactly maxFillPoints empty buckets besides the point
+	s := &timeSeries{name: "fits"}
+	s.append(start, &one)
+	if s.fill(fillModeNull, backend.TimeRange{From: start, To: start.Add(maxFillPoints * time.Second)}, time.Second, 0, nil) {
+		t.Error("fill reported the limit hit")
+	}
+	if len(s.times) != maxFillPoints+1 {
+		t.Errorf("got %d points, want %d", len(s.times), maxFillPoints+1)
+	}
+
+	// a point past the limit is kept, the buckets between are not filled
+	end := start.Add(2 * maxFillPoints * time.Second)
+	s = &timeSeries{name: "capped"}
+	s.append(end, &one)
+	if !s.fill(fillModeNull, backend.TimeRange{From: start, To: end}, time.Second, 0, nil) {
+		t.Error("fill did not report the limit hit")
+	}
+	if len(s.times) != maxFillPoints+1 || !s.times[len(s.times)-1].Equal(end) {
+		t.Errorf("got %d points ending at %v, want %d ending at %v", len(s.times), s.times[len(s.times)-1], maxFillPoints+1, end)
+	}
+}
+
+func TestBuildSeriesTimeSeriesResultFill(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := fakeResult{
+		columns: []fakeColumn{{name: "time", typeName: "timestamp"}, {name: "value", typeName: "float"}},
+		rows:    [][]driver.Value{{start, 1.0}},
+	}
+	qm := queryModel{Format: formatTimeSeries, Fill: fillModeNull}
+
+	// without an interval from Grafana the step comes from MaxDataPoints
+	query := backend.DataQuery{TimeRange: backend.TimeRange{From: start, To: start.Add(time.Hour)}, MaxDataPoints: 60}
+	frames, err := (&VerticaDatasource{}).buildSeriesTimeSeriesResult(queryFake(t, &fakeConnector{result: result}), qm, query, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := frameTimes(t, frames[0])
+	if len(times) != 61 || !times[1].Equal(start.Add(time.Minute)) {
+		t.Errorf("got %d points, want 61 a minute apart", len(times))
+	}
+
+	// a fill interval much smaller than the range hits the limit
+	qm.fillInterval = time.Millisecond
+	frames, err = (&VerticaDatasource{}).buildSeriesTimeSeriesResult(queryFake(t, &fakeConnector{result: result}), qm, query, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := frames[0].Fields[0].Len(); got != maxFillPoints+1 {
+		t.Errorf("got %d points, want %d", got, maxFillPoints+1)
+	}
+	if got := frames[0].Meta.Custom["fillTruncated"]; got != 1 {
+		t.Errorf("fillTruncated: got %v, want 1", got)
+	}
+	if len(frames[0].Meta.Notices) == 0 || !strings.Contains(frames[0].Meta.Notices[0].Text, "fill interval") {
+		t.Errorf("missing fill notice: %v", frames[0].Meta.Notices)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// bucketColumns are the names recognized as the bucket column of a heatmap.
+var bucketColumns = []string{"le", "bucket"}
+
+// bucketBound parses the upper bound of a heatmap bucket. Buckets that are not
+// numbers sort after +Inf.
+func bucketBound(bucket string) (float64, bool) {
+	bound, err := strconv.ParseFloat(strings.TrimSpace(bucket), 64)
+	if err != nil {
+		return math.Inf(1), false
+	}
+	return bound, true
+}
+
+// detectHeatmapColumns returns the time, bucket and count columns of a heatmap
+// result. Columns named in the query model take precedence.
+func detectHeatmapColumns(fields []*data.Field, qm queryModel) (int, int, int, error) {
+	var err error
+
+	timeIndex := -1
+	if qm.TimeColumn != "" {
+		if timeIndex, err = findColumn(fields, qm.TimeColumn); err != nil {
+			return 0, 0, 0, err
+		}
+	} else {
+		timeIndex = detectTimeColumn(fields)
+	}
+	if timeIndex == -1 || fields[timeIndex].Type() != data.FieldTypeNullableTime {
+		return 0, 0, 0, errors.New("no time column found")
+	}
+
+	bucketIndex := -1
+	if qm.MetricColumn != "" {
+		if bucketIndex, err = findColumn(fields, qm.MetricColumn); err != nil {
+			return 0, 0, 0, err
+		}
+	} else {
+		for _, name := range bucketColumns {
+			if bucketIndex, err = findColumn(fields, name); err == nil {
+				break
+			}
+		}
+	}
+	if bucketIndex == -1 {
+		return 0, 0, 0, fmt.Errorf("no bucket column found, name it %s", strings.Join(bucketColumns, " or "))
+	}
+
+	countIndex := -1
+	if len(qm.ValueColumns) > 0 {
+		if countIndex, err = findColumn(fields, qm.ValueColumns[0]); err != nil {
+			return 0, 0, 0, err
+		}
+	} else {
+		for i, field := range fields {
+			if i != timeIndex && i != bucketIndex && field.Type() == data.FieldTypeNullableFloat64 {
+				countIndex = i
+				break
+			}
+		}
+	}
+	if countIndex == -1 || fields[countIndex].Type() != data.FieldTypeNullableFloat64 {
+		return 0, 0, 0, errors.New("no numeric count column found")
+	}
+
+	return timeIndex, bucketIndex, countIndex, nil
+}
+
+// buildHeatmapResult converts (time, bucket, count) rows into one series per
+// bucket, ordered by the numeric upper bound of the buckets.
+func (v *VerticaDatasource) buildHeatmapResult(rows *sql.Rows, qm queryModel, query backend.DataQuery, config *configArgs) ([]*data.Frame, error) {
+	fields, converters, err := buildFields(rows, newFieldOptions(config, qm))
+	if err != nil {
+		return nil, err
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	if err := epochTimeColumns(fields, converters, colTypes, qm.TimeColumnType, epochUnitAuto); err != nil {
+		return nil, err
+	}
+
+	timeIndex, bucketIndex, countIndex, err := detectHeatmapColumns(fields, qm)
+	if err != nil {
+		return nil, err
+	}
+
+	series := newSeriesSet(config.SeriesLimit)
+	err = scanRows(rows, converters, func(values []interface{}) error {
+		t, ok := toTime(values[timeIndex], epochUnitAuto, nil)
+		if !ok {
+			return nil
+		}
+
+		var bucket string
+		switch b := values[bucketIndex].(type) {
+		case *string:
+			bucket = strings.TrimSpace(*b)
+		case *float64:
+			bucket = strconv.FormatFloat(*b, 'g', -1, 64)
+		default:
+			return nil
+		}
+
+		s, _ := series.get(bucket, nil, nil)
+		if s != nil {
+			s.append(t, toFloat(values[countIndex]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(series.order, func(i, j int) bool {
+		bi, iok := bucketBound(series.order[i].name)
+		bj, jok := bucketBound(series.order[j].name)
+		if iok != jok {
+			return iok
+		}
+		return bi < bj
+	})
+
+	frames := make([]*data.Frame, 0, len(series.order))
+	for _, s := range series.order {
+		if s.unordered {
+			s.sort()
+		}
+		frames = append(frames, s.toFrame())
+	}
+	if len(frames) == 0 {
+		frames = append(frames, data.NewFrame("results"))
+	}
+
+	meta := &data.FrameMeta{
+		ExecutedQueryString: qm.RawSQL,
+	}
+	if len(series.dropped) > 0 {
+		meta.Custom = map[string]interface{}{
+			"seriesTruncated": len(series.dropped),
+		}
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d buckets truncated, the limit is %d series", len(series.dropped), config.SeriesLimit),
+		})
+	}
+	frames[0].Meta = meta
+
+	return frames, nil
+}
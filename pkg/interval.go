@@ -0,0 +1,124 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The driver does not name interval types, it reports them by type OID.
+const (
+	intervalDayToSecondType = "unknown column type oid: 14"
+	intervalYearToMonthType = "unknown column type oid: 114"
+)
+
+var intervalValuePattern = regexp.MustCompile(`^(-)?(?:(\d+) )?(\d+):(\d+)(?::(\d+(?:\.\d+)?))?$`)
+
+// parseIntervalSeconds parses a day to second interval such as
+// -1 02:03:04.5 into seconds.
+func parseIntervalSeconds(value string) (float64, bool) {
+	match := intervalValuePattern.FindStringSubmatch(value)
+	if match == nil {
+		if days, err := strconv.Atoi(value); err == nil {
+			return float64(days) * 86400, true
+		}
+		return 0, false
+	}
+
+	seconds := 0.0
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if match[i+2] == "" {
+			continue
+		}
+		amount, err := strconv.ParseFloat(match[i+2], 64)
+		if err != nil {
+			return 0, false
+		}
+		seconds += amount * unit
+	}
+	if match[1] == "-" {
+		seconds = -seconds
+	}
+	return seconds, true
+}
+
+// formatIntervalColumns turns the day to second interval columns of frame,
+// described by colTypes, back into columns of interval strings.
+func formatIntervalColumns(frame *data.Frame, colTypes []*sql.ColumnType) {
+	for i, colType := range colTypes {
+		if colType.DatabaseTypeName() != intervalDayToSecondType || i >= len(frame.Fields) {
+			continue
+		}
+		field := frame.Fields[i]
+		values := make([]*string, field.Len())
+		for row := range values {
+			if f, ok := field.At(row).(*float64); ok && f != nil {
+				str := formatIntervalSeconds(*f)
+				values[row] = &str
+			}
+		}
+		frame.Fields[i] = data.NewField(field.Name, field.Labels, values)
+	}
+}
+
+// formatIntervalSeconds renders seconds in the interval notation Vertica uses.
+func formatIntervalSeconds(seconds float64) string {
+	sign := ""
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	d := time.Duration(math.Round(seconds*1e6)) * time.Microsecond
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	d -= minutes * time.Minute
+	secs := strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	if d < 10*time.Second {
+		secs = "0" + secs
+	}
+
+	if days > 0 {
+		return fmt.Sprintf("%s%d %02d:%02d:%s", sign, days, hours, minutes, secs)
+	}
+	return fmt.Sprintf("%s%02d:%02d:%s", sign, hours, minutes, secs)
+}
@@ -33,104 +33,707 @@ package main
 // THE SOFTWARE.
 
 import (
+	"errors"
 	"fmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
-	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
-const macroPattern = `\$(__[_a-zA-Z0-9]+)\(([^\)]*)\)`
+// timeLiteral renders t as a quoted timestamp literal. All time range macros
+// use it so their boundaries compare equal when combined in one query.
+func timeLiteral(t time.Time) string {
+	return fmt.Sprintf("'%s'", t.Format(time.RFC3339Nano))
+}
+
+// dateLiteral renders the date of t in location as a DATE literal.
+func dateLiteral(t time.Time, location *time.Location) string {
+	return fmt.Sprintf("DATE '%s'", t.In(location).Format("2006-01-02"))
+}
+
+// isAllMarker reports whether value is the value of a variable set to All,
+// either raw or interpolated as a string literal.
+func isAllMarker(value string) bool {
+	value = strings.TrimSpace(value)
+	if len(value) > 1 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+		value = value[1 : len(value)-1]
+	}
+	return value == "$__all" || value == "*"
+}
+
+// quoteLiteral returns value as a string literal. Values that already are a
+// single string literal, as multi-value variables are interpolated, are kept.
+func quoteLiteral(value string) string {
+	if strings.HasPrefix(value, "'") {
+		if end, kind := scanToken(value, 0); kind == tokenString && end == len(value) {
+			return value
+		}
+	}
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// maxIdentifierLength is the maximum length of a Vertica identifier in bytes.
+const maxIdentifierLength = 128
+
+// quoteIdentifier returns value as a quoted identifier. A value interpolated
+// as a string literal is unquoted first. Values that cannot be an identifier
+// are rejected rather than passed through.
+func quoteIdentifier(value string) (string, error) {
+	name := value
+	if strings.HasPrefix(name, "'") {
+		if end, kind := scanToken(name, 0); kind == tokenString && end == len(name) && len(name) > 1 {
+			name = strings.ReplaceAll(name[1:len(name)-1], "''", "'")
+		}
+	}
+	if name == "" || len(name) > maxIdentifierLength {
+		return "", fmt.Errorf("invalid identifier %q", value)
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return "", fmt.Errorf("invalid identifier %q", value)
+		}
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`, nil
+}
+
+// epochFloor returns t as epoch seconds rounded down.
+func epochFloor(t time.Time) int64 {
+	return t.Truncate(time.Second).Unix()
+}
+
+// epochCeil returns t as epoch seconds rounded up, so a range ending at t is
+// fully covered by whole seconds.
+func epochCeil(t time.Time) int64 {
+	if t.Equal(t.Truncate(time.Second)) {
+		return t.Unix()
+	}
+	return t.Truncate(time.Second).Unix() + 1
+}
+
+var macroIntervalPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(ms|s|m|h|d)$`)
+
+var macroIntervalUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+}
+
+// parseMacroInterval parses a macro interval argument such as '5m' or
+// '$__interval', which stands for the interval of the query.
+func parseMacroInterval(arg string, query backend.DataQuery) (time.Duration, error) {
+	token := strings.Trim(strings.TrimSpace(arg), "'\"")
+	if token == "$__interval" {
+		if query.Interval <= 0 {
+			return 0, errors.New("$__interval is not set")
+		}
+		return query.Interval, nil
+	}
+
+	match := macroIntervalPattern.FindStringSubmatch(token)
+	if match == nil {
+		return 0, fmt.Errorf("invalid interval %q", token)
+	}
+	amount, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q", token)
+	}
+	interval := time.Duration(amount * float64(macroIntervalUnits[match[2]]))
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", token)
+	}
+	return interval, nil
+}
+
+// parseMacroOffset parses the bucket offset argument of a macro, which may be
+// negative, and normalizes it to [0, interval).
+func parseMacroOffset(arg string, interval time.Duration, query backend.DataQuery) (time.Duration, error) {
+	token := strings.Trim(arg, "'")
+	negative := strings.HasPrefix(token, "-")
+	offset, err := parseMacroInterval(strings.TrimPrefix(token, "-"), query)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %q", token)
+	}
+	if negative {
+		offset = -offset
+	}
+	return (offset%interval + interval) % interval, nil
+}
+
+var dayShiftPattern = regexp.MustCompile(`^(\d+)d$`)
+
+// timeShift moves times back by a duration or by whole days. Days are
+// calendar days in the session timezone, so a 7d shift keeps the wall clock
+// time across DST transitions.
+type timeShift struct {
+	days     int
+	duration time.Duration
+	location *time.Location
+}
+
+// parseTimeShift parses the shift argument of $__timeFilterOffset.
+func parseTimeShift(arg string, query backend.DataQuery, location *time.Location) (*timeShift, error) {
+	token := strings.Trim(strings.TrimSpace(arg), "'\"")
+	if match := dayShiftPattern.FindStringSubmatch(token); match != nil {
+		days, err := strconv.Atoi(match[1])
+		if err != nil || days == 0 {
+			return nil, fmt.Errorf("invalid shift %q", token)
+		}
+		return &timeShift{days: days, location: location}, nil
+	}
+	duration, err := parseMacroInterval(token, query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shift %q", token)
+	}
+	return &timeShift{duration: duration}, nil
+}
+
+// back returns t shifted into the past.
+func (s *timeShift) back(t time.Time) time.Time {
+	if s.days != 0 {
+		return t.In(s.location).AddDate(0, 0, -s.days)
+	}
+	return t.Add(-s.duration)
+}
+
+// forward undoes back.
+func (s *timeShift) forward(t time.Time) time.Time {
+	if s.days != 0 {
+		return t.In(s.location).AddDate(0, 0, s.days)
+	}
+	return t.Add(s.duration)
+}
+
+// intervalSeconds renders interval as a number of seconds for SQL arithmetic.
+func intervalSeconds(interval time.Duration) string {
+	return strconv.FormatFloat(interval.Seconds(), 'f', -1, 64)
+}
+
+// calendarUnits maps the $__timeGroup intervals that are aligned to calendar
+// boundaries to their unit and nominal width.
+var calendarUnits = map[string]struct {
+	unit    string
+	nominal time.Duration
+}{
+	"1d": {calendarDay, 24 * time.Hour},
+	"1w": {calendarWeek, 7 * 24 * time.Hour},
+	"1M": {calendarMonth, 30 * 24 * time.Hour},
+}
 
-func evaluateMacro(name string, args []string, timeRange backend.TimeRange) (string, error) {
+// calendarGroupExpression truncates column to the calendar buckets of
+// calendar in the session timezone. DATE_TRUNC weeks start on Monday, so
+// weeks starting on Sunday are shifted by a day.
+func calendarGroupExpression(column string, calendar *calendarBucket) string {
+	if calendar.unit == calendarWeek && calendar.weekStart == time.Sunday {
+		return fmt.Sprintf("DATE_TRUNC('week', %s + INTERVAL '1 day') - INTERVAL '1 day'", column)
+	}
+	return fmt.Sprintf("DATE_TRUNC('%s', %s)", calendar.unit, column)
+}
+
+// timeSliceUnits are the TIME_SLICE units from the largest to the smallest.
+var timeSliceUnits = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"HOUR", time.Hour},
+	{"MINUTE", time.Minute},
+	{"SECOND", time.Second},
+	{"MILLISECOND", time.Millisecond},
+}
+
+// timeSliceExpression returns the TIME_SLICE call bucketing column by interval.
+// TIME_SLICE counts slices from 2000-01-01, a whole number of days after the
+// Unix epoch, so it only matches the epoch arithmetic for intervals that
+// divide a day. It returns false for other intervals.
+func timeSliceExpression(column string, interval time.Duration) (string, bool) {
+	if interval <= 0 || (24*time.Hour)%interval != 0 {
+		return "", false
+	}
+	for _, unit := range timeSliceUnits {
+		if interval%unit.duration == 0 {
+			return fmt.Sprintf("TIME_SLICE(%s, %d, '%s')", column, interval/unit.duration, unit.name), true
+		}
+	}
+	return "", false
+}
+
+// timeGroupExpression truncates column to buckets of interval and returns the
+// start of the bucket as a timestamp. Bucket boundaries are shifted by offset.
+// With timeSlice set, Vertica's TIME_SLICE is used where it yields the same
+// buckets.
+func timeGroupExpression(column string, interval time.Duration, offset time.Duration, timeSlice bool) string {
+	if timeSlice && offset == 0 {
+		if expression, ok := timeSliceExpression(column, interval); ok {
+			return expression
+		}
+	}
+	seconds := intervalSeconds(interval)
+	if offset != 0 {
+		shift := intervalSeconds(offset)
+		return fmt.Sprintf("TO_TIMESTAMP(FLOOR((EXTRACT(EPOCH FROM %s) - %s) / %s) * %s + %s)", column, shift, seconds, seconds, shift)
+	}
+	return fmt.Sprintf("TO_TIMESTAMP(FLOOR(EXTRACT(EPOCH FROM %s) / %s) * %s)", column, seconds, seconds)
+}
+
+var (
+	intervalPattern   = regexp.MustCompile(`\$__interval\b`)
+	intervalMsPattern = regexp.MustCompile(`\$__interval_ms\b`)
+)
+
+// queryInterval returns the interval of query. When Grafana did not send one,
+// it is derived from the time range and MaxDataPoints.
+func queryInterval(query backend.DataQuery) time.Duration {
+	if query.Interval > 0 {
+		return query.Interval
+	}
+	maxDataPoints := query.MaxDataPoints
+	if maxDataPoints <= 0 {
+		maxDataPoints = 1000
+	}
+	interval := query.TimeRange.To.Sub(query.TimeRange.From) / time.Duration(maxDataPoints)
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	return interval.Round(time.Millisecond)
+}
+
+// formatInterval renders interval in the largest unit that divides it, such as
+// 30s or 5m.
+func formatInterval(interval time.Duration) string {
+	for _, unit := range []struct {
+		suffix   string
+		duration time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	} {
+		if interval%unit.duration == 0 {
+			return fmt.Sprintf("%d%s", interval/unit.duration, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dms", interval/time.Millisecond)
+}
+
+// intervalLiteral renders interval as a Vertica INTERVAL literal in the
+// largest unit it spans, rounded to a whole number of at least one unit.
+func intervalLiteral(interval time.Duration) string {
+	units := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"days", 24 * time.Hour},
+		{"hours", time.Hour},
+		{"minutes", time.Minute},
+		{"seconds", time.Second},
+		{"milliseconds", time.Millisecond},
+	}
+	unit := units[len(units)-1]
+	for _, u := range units {
+		if interval >= u.duration {
+			unit = u
+			break
+		}
+	}
+	amount := int64(math.Round(float64(interval) / float64(unit.duration)))
+	if amount < 1 {
+		amount = 1
+	}
+	return fmt.Sprintf("INTERVAL '%d %s'", amount, unit.name)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `'`, `''`)
+
+// searchFilterLiteral returns the quoted LIKE pattern $__searchFilter expands
+// to, matching values that contain filter. Wildcards and quotes typed by the
+// user are escaped; an empty filter matches everything.
+func searchFilterLiteral(filter string) string {
+	if filter == "" {
+		return "'%'"
+	}
+	return "'%" + likeEscaper.Replace(filter) + "%'"
+}
+
+// macroState collects what macros of a query pass on to the response builders.
+type macroState struct {
+	fillMode     string
+	fillInterval time.Duration
+	fillCalendar *calendarBucket
+	fillOffset   time.Duration
+	timeShift    *timeShift
+	// epochUnit is the unit of the epochs a macro grouped by.
+	epochUnit string
+	// expansions lists the event series clauses macros expanded to.
+	expansions []string
+
+	// config and location are the datasource options and session timezone
+	// macros are expanded for.
+	config   *configArgs
+	location *time.Location
+}
+
+func evaluateMacro(name string, args []string, query backend.DataQuery, state *macroState) (string, error) {
 	switch name {
 	case "__time":
 		if len(args) == 0 {
-			return "", fmt.Errorf("missing time column argument for macro %v", name)
+			return "", errors.New("missing time column argument")
 		}
 		return fmt.Sprintf("%s AS time", args[0]), nil
+	case "__timeEpoch":
+		if len(args) == 0 {
+			return "", errors.New("missing time column argument")
+		}
+		return fmt.Sprintf(`FLOOR(EXTRACT(EPOCH FROM (%s)) * 1000)::INTEGER AS "time"`, args[0]), nil
 	case "__timeFilter":
 		if len(args) == 0 {
-			return "", fmt.Errorf("missing time column argument for macro %v", name)
+			return "", errors.New("missing time column argument")
+		}
+		return fmt.Sprintf("%s BETWEEN %s AND %s",
+			args[0],
+			timeLiteral(query.TimeRange.From),
+			timeLiteral(query.TimeRange.To),
+		), nil
+	case "__dateFilter":
+		if len(args) == 0 {
+			return "", errors.New("missing date column argument")
+		}
+		// Both ends are inclusive, so a range not on day boundaries is widened
+		// to the whole days it touches.
+		return fmt.Sprintf("%s BETWEEN %s AND %s",
+			args[0],
+			dateLiteral(query.TimeRange.From, state.location),
+			dateLiteral(query.TimeRange.To, state.location),
+		), nil
+	case "__timeFilterOffset":
+		if len(args) < 2 {
+			return "", errors.New("time column and shift arguments expected")
+		}
+		shift, err := parseTimeShift(args[1], query, state.location)
+		if err != nil {
+			return "", err
+		}
+		state.timeShift = shift
+		return fmt.Sprintf("%s BETWEEN %s AND %s",
+			args[0],
+			timeLiteral(shift.back(query.TimeRange.From)),
+			timeLiteral(shift.back(query.TimeRange.To)),
+		), nil
+	case "__timeRangeOverlaps":
+		if len(args) != 2 {
+			return "", errors.New("start and end column arguments expected")
 		}
-		return fmt.Sprintf("%s BETWEEN '%s' AND '%s'",
+		// Rows without an end are still open and overlap any later range.
+		return fmt.Sprintf("(%s <= %s AND (%s >= %s OR %s IS NULL))",
 			args[0],
-			timeRange.From.Format(time.RFC3339Nano),
-			timeRange.To.Format(time.RFC3339Nano),
+			timeLiteral(query.TimeRange.To),
+			args[1],
+			timeLiteral(query.TimeRange.From),
+			args[1],
 		), nil
 	case "__timeFrom":
 		if len(args) != 0 {
-			return "", fmt.Errorf("macro %v should have no arguments", name)
+			return "", errors.New("no arguments expected")
 		}
-		return fmt.Sprintf("'%s'", timeRange.From.Format(time.RFC3339Nano)), nil
+		return timeLiteral(query.TimeRange.From), nil
 	case "__timeTo":
 		if len(args) != 0 {
-			return "", fmt.Errorf("macro %v should have no arguments", name)
+			return "", errors.New("no arguments expected")
 		}
-		return fmt.Sprintf("'%s'", timeRange.To.Format(time.RFC3339Nano)), nil
+		return timeLiteral(query.TimeRange.To), nil
 	case "__unixEpochFilter":
 		if len(args) == 0 {
-			return "", fmt.Errorf("missing time column argument for macro %v", name)
+			return "", errors.New("missing time column argument")
 		}
-		return fmt.Sprintf("%s >= %d AND %s <= %d", args[0], timeRange.From.Unix(), args[0], timeRange.To.Unix()), nil
-	default:
-		return "", fmt.Errorf("undefined macro: $__%v", name)
-	}
-}
-
-func replaceAllStringSubmatchFunc(re *regexp.Regexp, str string, repl func([]string) (string, error)) (string, error) {
-	result := ""
-	lastIndex := 0
-
-	for _, v := range re.FindAllSubmatchIndex([]byte(str), -1) {
-		var groups []string
-		for i := 0; i < len(v); i += 2 {
-			groups = append(groups, str[v[i]:v[i+1]])
+		return fmt.Sprintf("%s >= %d AND %s <= %d", args[0], epochFloor(query.TimeRange.From), args[0], epochCeil(query.TimeRange.To)), nil
+	case "__unixEpochFrom":
+		if len(args) != 0 {
+			return "", errors.New("no arguments expected")
 		}
-
-		replacement, err := repl(groups)
-
+		return fmt.Sprintf("%d", epochFloor(query.TimeRange.From)), nil
+	case "__unixEpochTo":
+		if len(args) != 0 {
+			return "", errors.New("no arguments expected")
+		}
+		return fmt.Sprintf("%d", epochCeil(query.TimeRange.To)), nil
+	case "__timeGroup":
+		if len(args) < 2 {
+			return "", errors.New("time column and interval arguments expected")
+		}
+		var calendar *calendarBucket
+		var interval, offset time.Duration
+		var expression string
+		if unit, ok := calendarUnits[strings.Trim(args[1], "'")]; ok {
+			if len(args) > 3 {
+				return "", errors.New("offset is not supported for calendar intervals")
+			}
+			calendar = &calendarBucket{unit: unit.unit, weekStart: state.config.weekStartDay(), location: state.location}
+			interval = unit.nominal
+			expression = calendarGroupExpression(args[0], calendar)
+		} else {
+			var err error
+			if interval, err = parseMacroInterval(args[1], query); err != nil {
+				return "", err
+			}
+			if len(args) > 3 {
+				if offset, err = parseMacroOffset(args[3], interval, query); err != nil {
+					return "", err
+				}
+			}
+			expression = timeGroupExpression(args[0], interval, offset, state.config.TimeSlice)
+		}
+		if len(args) > 2 {
+			fillMode, err := parseFillMode(args[2])
+			if err != nil {
+				return "", fmt.Errorf("invalid fill %q", args[2])
+			}
+			state.fillMode = fillMode
+			state.fillInterval = interval
+			state.fillCalendar = calendar
+			state.fillOffset = offset
+		}
+		return expression, nil
+	case "__timeGroupAlias":
+		res, err := evaluateMacro("__timeGroup", args, query, state)
 		if err != nil {
 			return "", err
 		}
-
-		result += str[lastIndex:v[0]] + replacement
-
-		lastIndex = v[1]
+		return res + ` AS "time"`, nil
+	case "__unixEpochGroup":
+		if len(args) < 2 {
+			return "", errors.New("time column and interval arguments expected")
+		}
+		interval, err := parseMacroInterval(args[1], query)
+		if err != nil {
+			return "", err
+		}
+		if interval%time.Second != 0 {
+			return "", fmt.Errorf("interval %q is not a whole number of seconds", args[1])
+		}
+		if len(args) > 2 {
+			fillMode, err := parseFillMode(args[2])
+			if err != nil {
+				return "", fmt.Errorf("invalid fill %q", args[2])
+			}
+			state.fillMode = fillMode
+			state.fillInterval = interval
+		}
+		// the buckets are INTEGER epoch seconds, which must not be read as
+		// milliseconds on the time axis
+		state.epochUnit = epochUnitSeconds
+		seconds := int64(interval / time.Second)
+		return fmt.Sprintf("FLOOR(%s / %d)::INTEGER * %d", args[0], seconds, seconds), nil
+	case "__unixEpochGroupAlias":
+		res, err := evaluateMacro("__unixEpochGroup", args, query, state)
+		if err != nil {
+			return "", err
+		}
+		return res + ` AS "time"`, nil
+	case "__conditionalAll":
+		if len(args) < 2 {
+			return "", errors.New("condition and variable arguments expected")
+		}
+		// A multi-value variable spreads over the remaining arguments.
+		if len(args) == 2 && isAllMarker(args[1]) {
+			return "1=1", nil
+		}
+		return args[0], nil
+	case "__quoteList":
+		if len(args) == 0 {
+			// An empty selection matches nothing instead of breaking IN ().
+			return "NULL", nil
+		}
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = quoteLiteral(arg)
+		}
+		return strings.Join(quoted, ","), nil
+	case "__quoteIdent":
+		if len(args) != 1 {
+			return "", errors.New("one identifier argument expected")
+		}
+		return quoteIdentifier(args[0])
+	case "__timeseries":
+		if len(args) == 0 {
+			return "", errors.New("missing time column argument")
+		}
+		interval := query.Interval
+		if len(args) > 1 {
+			var err error
+			if interval, err = parseMacroInterval(args[1], query); err != nil {
+				return "", err
+			}
+		}
+		over := "ORDER BY " + args[0]
+		if len(args) > 2 {
+			over = "PARTITION BY " + strings.Join(args[2:], ", ") + " " + over
+		}
+		res := fmt.Sprintf("TIMESERIES slice_time AS '%s seconds' OVER (%s)", intervalSeconds(interval), over)
+		state.expansions = append(state.expansions, res)
+		return res, nil
+	case "__interpolate":
+		if len(args) == 0 {
+			return "", errors.New("missing column argument")
+		}
+		mode := "LINEAR"
+		if len(args) > 1 {
+			mode = strings.ToUpper(strings.Trim(args[1], "'"))
+			if mode != "LINEAR" && mode != "CONST" {
+				return "", fmt.Errorf("invalid interpolation %q", args[1])
+			}
+		}
+		res := fmt.Sprintf("TS_FIRST_VALUE(%s, '%s')", args[0], mode)
+		state.expansions = append(state.expansions, res)
+		return res, nil
+	default:
+		return "", errors.New("undefined macro")
 	}
+}
 
-	return result + str[lastIndex:], nil
+// macroError reports a macro that failed to expand, along with its name and
+// character offset in the raw SQL.
+type macroError struct {
+	Macro  string
+	Offset int
+	Err    error
 }
 
-func sanitizeAndInterpolateMacros(rawSql string, tsdbReq backend.DataQuery) (string, error) {
+func (e *macroError) Error() string {
+	return fmt.Sprintf("%v in $%v at offset %d", e.Err, e.Macro, e.Offset)
+}
 
-	regex, err := regexp.Compile(macroPattern)
+func (e *macroError) Unwrap() error {
+	return e.Err
+}
 
-	if err != nil {
-		log.DefaultLogger.Error(err.Error())
-		return rawSql, err
+// parseMacroArgs splits the parenthesized arguments of a macro starting at
+// offset i of sql on top level commas. It returns the trimmed arguments, their
+// offsets in sql and the offset just past the closing parenthesis.
+func parseMacroArgs(sql string, i int) ([]string, []int, int, error) {
+	var args []string
+	var offsets []int
+	depth := 0
+	start := i + 1
+	appendArg := func(end int) {
+		arg := strings.TrimLeftFunc(sql[start:end], unicode.IsSpace)
+		offsets = append(offsets, end-len(arg))
+		args = append(args, strings.TrimRightFunc(arg, unicode.IsSpace))
 	}
+	for j := i + 1; j < len(sql); {
+		end, kind := scanToken(sql, j)
+		if kind != tokenCode {
+			j = end
+			continue
+		}
+		switch sql[j] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				appendArg(j)
+				if len(args) == 1 && args[0] == "" {
+					return nil, nil, j + 1, nil
+				}
+				return args, offsets, j + 1, nil
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				appendArg(j)
+				start = j + 1
+			}
+		}
+		j++
+	}
+	return nil, nil, 0, errors.New("missing closing parenthesis")
+}
 
-	sql, err := replaceAllStringSubmatchFunc(regex, rawSql, func(groups []string) (string, error) {
+// interpolateLiteral expands the interval variables inside a string literal,
+// so that literals like INTERVAL '$__interval' keep working.
+func interpolateLiteral(literal string, interval time.Duration) string {
+	literal = intervalMsPattern.ReplaceAllLiteralString(literal, strconv.FormatInt(int64(interval/time.Millisecond), 10))
+	return intervalPattern.ReplaceAllLiteralString(literal, formatInterval(interval))
+}
+
+// interpolate expands the macros and variables of sql, which starts at offset
+// of the raw SQL. Macros are only expanded in code, never inside comments,
+// quoted identifiers or string literals; string literals only get the interval
+// variables expanded.
+func interpolate(sql string, offset int, tsdbReq backend.DataQuery, variables map[string]string, state *macroState) (string, error) {
+	var result strings.Builder
+	for i := 0; i < len(sql); {
+		end, kind := scanToken(sql, i)
+		switch {
+		case kind == tokenString:
+			result.WriteString(interpolateLiteral(sql[i:end], tsdbReq.Interval))
+			i = end
+			continue
+		case kind != tokenCode:
+			result.WriteString(sql[i:end])
+			i = end
+			continue
+		case !strings.HasPrefix(sql[i:], "$__"):
+			result.WriteByte(sql[i])
+			i++
+			continue
+		}
 
-		var args []string
+		nameEnd := i + 1
+		for nameEnd < len(sql) && isIdentChar(sql[nameEnd]) {
+			nameEnd++
+		}
+		name := sql[i+1 : nameEnd]
 
-		if len(groups) > 2 && len(groups[2]) > 0 {
-			args = strings.Split(groups[2], ",")
-			for i, arg := range args {
-				args[i] = strings.Trim(arg, " ")
+		if nameEnd >= len(sql) || sql[nameEnd] != '(' {
+			if value, ok := variables[name]; ok {
+				result.WriteString(value)
+			} else {
+				result.WriteString(sql[i:nameEnd])
 			}
+			i = nameEnd
+			continue
 		}
 
-		res, err := evaluateMacro(groups[1], args, tsdbReq.TimeRange)
+		args, argOffsets, argsEnd, err := parseMacroArgs(sql, nameEnd)
+		if err != nil {
+			return "", &macroError{Macro: name, Offset: offset + i, Err: err}
+		}
+		for k, arg := range args {
+			if args[k], err = interpolate(arg, offset+argOffsets[k], tsdbReq, variables, state); err != nil {
+				return "", err
+			}
+		}
 
+		res, err := evaluateMacro(name, args, tsdbReq, state)
 		if err != nil {
-			return "", err
+			return "", &macroError{Macro: name, Offset: offset + i, Err: err}
 		}
+		result.WriteString(res)
+		i = argsEnd
+	}
+	return result.String(), nil
+}
 
-		return res, nil
-	})
+func sanitizeAndInterpolateMacros(rawSql string, tsdbReq backend.DataQuery, searchFilter string, config *configArgs, location *time.Location) (string, *macroState, error) {
+	state := &macroState{config: config, location: location}
+
+	tsdbReq.Interval = queryInterval(tsdbReq)
+	variables := map[string]string{
+		"__interval":        formatInterval(tsdbReq.Interval),
+		"__interval_ms":     strconv.FormatInt(int64(tsdbReq.Interval/time.Millisecond), 10),
+		"__intervalLiteral": intervalLiteral(tsdbReq.Interval),
+		"__searchFilter":    searchFilterLiteral(searchFilter),
+	}
+
+	sql, err := interpolate(rawSql, 0, tsdbReq, variables, state)
+	if err != nil {
+		return "", nil, err
+	}
 
-	return sql, err
+	return sql, state, nil
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// expandMacros expands the macros of rawSql for a one hour range starting at
+// from with a one minute interval, in UTC.
+func expandMacros(t *testing.T, rawSql string, from time.Time) (string, error) {
+	t.Helper()
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := backend.DataQuery{
+		Interval:  time.Minute,
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+	}
+	sql, _, err := sanitizeAndInterpolateMacros(rawSql, query, "", config, time.UTC)
+	return sql, err
+}
+
+func TestInterpolateHostileInput(t *testing.T) {
+	const filter = "BETWEEN '2024-01-01T00:00:00Z' AND '2024-01-01T01:00:00Z'"
+	tests := []struct {
+		name    string
+		sql     string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "unclosed macro",
+			sql:     "SELECT * FROM t WHERE $__timeFilter(ts",
+			wantErr: "missing closing parenthesis in $__timeFilter at offset 22",
+		},
+		{
+			name:    "unclosed nested call",
+			sql:     "SELECT * FROM t WHERE $__timeFilter(COALESCE(ts, now())",
+			wantErr: "missing closing parenthesis in $__timeFilter at offset 22",
+		},
+		{
+			name: "extra closing parenthesis is left to Vertica",
+			sql:  "SELECT * FROM t WHERE $__timeFilter(ts))",
+			want: "SELECT * FROM t WHERE ts " + filter + ")",
+		},
+		{
+			name: "nested call",
+			sql:  "SELECT * FROM t WHERE $__timeFilter(COALESCE(ts, now()))",
+			want: "SELECT * FROM t WHERE COALESCE(ts, now()) " + filter,
+		},
+		{
+			name: "parenthesis and comma in a string argument",
+			sql:  "SELECT $__time(TO_TIMESTAMP(s, ')(,'))",
+			want: "SELECT TO_TIMESTAMP(s, ')(,') AS time",
+		},
+		{
+			name: "doubled quote in a string argument",
+			sql:  "SELECT $__time(TO_TIMESTAMP(s, 'YYYY''), '))",
+			want: "SELECT TO_TIMESTAMP(s, 'YYYY''), ') AS time",
+		},
+		{
+			name: "escaped quote in an E string argument",
+			sql:  `SELECT $__time(TO_TIMESTAMP(s, E'\'),'))`,
+			want: `SELECT TO_TIMESTAMP(s, E'\'),') AS time`,
+		},
+		{
+			name: "quoted identifier argument",
+			sql:  `SELECT * FROM t WHERE $__timeFilter("my ""ts)"" col")`,
+			want: `SELECT * FROM t WHERE "my ""ts)"" col" ` + filter,
+		},
+		{
+			name:    "unterminated string argument",
+			sql:     "SELECT * FROM t WHERE $__timeFilter(ts, ')",
+			wantErr: "missing closing parenthesis in $__timeFilter at offset 22",
+		},
+		{
+			name:    "missing argument",
+			sql:     "SELECT * FROM t WHERE $__timeFilter()",
+			wantErr: "missing time column argument in $__timeFilter at offset 22",
+		},
+		{
+			name:    "error in a nested macro",
+			sql:     "SELECT $__time($__timeGroup(ts))",
+			wantErr: "time column and interval arguments expected in $__timeGroup at offset 15",
+		},
+		{
+			name:    "undefined macro",
+			sql:     "SELECT $__bogus(ts)",
+			wantErr: "undefined macro in $__bogus at offset 7",
+		},
+		{
+			name: "macro in a string",
+			sql:  "SELECT '$__timeFilter(ts' AS s",
+			want: "SELECT '$__timeFilter(ts' AS s",
+		},
+		{
+			name: "interval variable in a string",
+			sql:  "SELECT INTERVAL '$__interval', '$__interval_ms'",
+			want: "SELECT INTERVAL '1m', '60000'",
+		},
+		{
+			name: "macro in an E string",
+			sql:  `SELECT E'\' $__timeFrom(' AS s`,
+			want: `SELECT E'\' $__timeFrom(' AS s`,
+		},
+		{
+			name: "macro in a dollar quoted string",
+			sql:  "SELECT $tag$ $__timeFrom( $tag$ AS s",
+			want: "SELECT $tag$ $__timeFrom( $tag$ AS s",
+		},
+		{
+			name: "macro in a quoted identifier",
+			sql:  `SELECT 1 AS "$__timeFrom("`,
+			want: `SELECT 1 AS "$__timeFrom("`,
+		},
+		{
+			name: "macro in a line comment",
+			sql:  "SELECT 1 -- $__timeFilter(ts\n, $__timeFrom()",
+			want: "SELECT 1 -- $__timeFilter(ts\n, '2024-01-01T00:00:00Z'",
+		},
+		{
+			name: "macro in a nested block comment",
+			sql:  "SELECT /* /* */ $__timeFilter( */ $__timeTo()",
+			want: "SELECT /* /* */ $__timeFilter( */ '2024-01-01T01:00:00Z'",
+		},
+		{
+			name: "unterminated block comment",
+			sql:  "SELECT 1 /* $__timeFilter(",
+			want: "SELECT 1 /* $__timeFilter(",
+		},
+		{
+			name: "comment in an argument",
+			sql:  "SELECT * FROM t WHERE $__timeFilter(ts /* ) */)",
+			want: "SELECT * FROM t WHERE ts /* ) */ " + filter,
+		},
+	}
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		got, err := expandMacros(t, tt.sql, from)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %v, want %s", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimeSliceExpression(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     string
+	}{
+		{interval: time.Hour, want: "TIME_SLICE(ts, 1, 'HOUR')"},
+		{interval: 24 * time.Hour, want: "TIME_SLICE(ts, 24, 'HOUR')"},
+		{interval: 90 * time.Minute, want: "TIME_SLICE(ts, 90, 'MINUTE')"},
+		{interval: 1500 * time.Millisecond, want: "TIME_SLICE(ts, 1500, 'MILLISECOND')"},
+		{interval: 7 * time.Hour},
+		{interval: 48 * time.Hour},
+		{interval: 7 * 24 * time.Hour},
+		{interval: 0},
+	}
+	for _, tt := range tests {
+		got, ok := timeSliceExpression("ts", tt.interval)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("%v: got %q (%v), want %q", tt.interval, got, ok, tt.want)
+		}
+	}
+}
+
+func TestTimeSliceMatchesEpochBuckets(t *testing.T) {
+	// TIME_SLICE counts slices from 2000-01-01, the epoch arithmetic of
+	// $__timeGroup from 1970-01-01: the buckets must agree on leap days and
+	// around DST transitions, which happen on UTC instants.
+	sliceStart := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	instants := []time.Time{
+		time.Date(2024, 2, 28, 23, 59, 59, 999e6, time.UTC),
+		time.Date(2024, 2, 29, 12, 34, 56, 0, time.UTC),
+		time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC),    // Europe/Berlin to CEST
+		time.Date(2024, 10, 27, 0, 59, 59, 0, time.UTC), // Europe/Berlin back to CET
+		time.Date(2024, 3, 10, 7, 30, 0, 0, time.UTC),   // America/New_York to EDT
+		time.Date(2024, 11, 3, 5, 59, 59, 0, time.UTC),  // America/New_York back to EST
+	}
+	for _, interval := range []time.Duration{time.Hour, 90 * time.Minute, 3 * time.Hour, 24 * time.Hour, 1500 * time.Millisecond} {
+		if _, ok := timeSliceExpression("ts", interval); !ok {
+			t.Fatalf("%v: no TIME_SLICE", interval)
+		}
+		for _, instant := range instants {
+			slice := sliceStart.Add(instant.Sub(sliceStart) / interval * interval)
+			if epoch := alignDown(instant, interval); !slice.Equal(epoch) {
+				t.Errorf("%v at %v: TIME_SLICE bucket %v, epoch bucket %v", interval, instant, slice, epoch)
+			}
+		}
+	}
+}
+
+func TestCalendarGroupExpression(t *testing.T) {
+	tests := []struct {
+		calendar calendarBucket
+		want     string
+	}{
+		{calendar: calendarBucket{unit: calendarDay}, want: "DATE_TRUNC('day', ts)"},
+		{calendar: calendarBucket{unit: calendarWeek, weekStart: time.Monday}, want: "DATE_TRUNC('week', ts)"},
+		{calendar: calendarBucket{unit: calendarWeek, weekStart: time.Sunday}, want: "DATE_TRUNC('week', ts + INTERVAL '1 day') - INTERVAL '1 day'"},
+		{calendar: calendarBucket{unit: calendarMonth}, want: "DATE_TRUNC('month', ts)"},
+	}
+	for _, tt := range tests {
+		if got := calendarGroupExpression("ts", &tt.calendar); got != tt.want {
+			t.Errorf("%s/%v: got %s, want %s", tt.calendar.unit, tt.calendar.weekStart, got, tt.want)
+		}
+	}
+}
+
+func TestCalendarBuckets(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		unit      string
+		weekStart time.Weekday
+		location  *time.Location
+		at        time.Time
+		floor     time.Time
+		width     time.Duration
+	}{
+		{
+			name: "leap day", unit: calendarDay, location: time.UTC,
+			at:    time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC),
+			floor: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), width: 24 * time.Hour,
+		},
+		{
+			name: "leap month", unit: calendarMonth, location: time.UTC,
+			at:    time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+			floor: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), width: 29 * 24 * time.Hour,
+		},
+		{
+			name: "week of the leap day from Monday", unit: calendarWeek, weekStart: time.Monday, location: time.UTC,
+			at:    time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+			floor: time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), width: 7 * 24 * time.Hour,
+		},
+		{
+			name: "week of the leap day from Sunday", unit: calendarWeek, weekStart: time.Sunday, location: time.UTC,
+			at:    time.Date(2024, 3, 2, 23, 0, 0, 0, time.UTC),
+			floor: time.Date(2024, 2, 25, 0, 0, 0, 0, time.UTC), width: 7 * 24 * time.Hour,
+		},
+		{
+			name: "Berlin spring forward", unit: calendarDay, location: berlin,
+			at:    time.Date(2024, 3, 31, 3, 30, 0, 0, berlin),
+			floor: time.Date(2024, 3, 31, 0, 0, 0, 0, berlin), width: 23 * time.Hour,
+		},
+		{
+			name: "Berlin fall back", unit: calendarDay, location: berlin,
+			at:    time.Date(2024, 10, 27, 2, 30, 0, 0, berlin),
+			floor: time.Date(2024, 10, 27, 0, 0, 0, 0, berlin), width: 25 * time.Hour,
+		},
+		{
+			name: "Berlin week with spring forward", unit: calendarWeek, weekStart: time.Monday, location: berlin,
+			at:    time.Date(2024, 3, 31, 12, 0, 0, 0, berlin),
+			floor: time.Date(2024, 3, 25, 0, 0, 0, 0, berlin), width: 7*24*time.Hour - time.Hour,
+		},
+		{
+			name: "Berlin month with fall back", unit: calendarMonth, location: berlin,
+			at:    time.Date(2024, 10, 27, 2, 30, 0, 0, berlin),
+			floor: time.Date(2024, 10, 1, 0, 0, 0, 0, berlin), width: 31*24*time.Hour + time.Hour,
+		},
+		{
+			name: "New York spring forward", unit: calendarDay, location: newYork,
+			at:    time.Date(2024, 3, 10, 23, 59, 0, 0, newYork),
+			floor: time.Date(2024, 3, 10, 0, 0, 0, 0, newYork), width: 23 * time.Hour,
+		},
+		{
+			name: "New York fall back", unit: calendarDay, location: newYork,
+			at:    time.Date(2024, 11, 3, 1, 30, 0, 0, newYork),
+			floor: time.Date(2024, 11, 3, 0, 0, 0, 0, newYork), width: 25 * time.Hour,
+		},
+		{
+			name: "New York week from Sunday with fall back", unit: calendarWeek, weekStart: time.Sunday, location: newYork,
+			at:    time.Date(2024, 11, 9, 23, 0, 0, 0, newYork),
+			floor: time.Date(2024, 11, 3, 0, 0, 0, 0, newYork), width: 7*24*time.Hour + time.Hour,
+		},
+		{
+			name: "New York day read in UTC", unit: calendarDay, location: newYork,
+			at:    time.Date(2024, 3, 11, 3, 0, 0, 0, time.UTC),
+			floor: time.Date(2024, 3, 10, 0, 0, 0, 0, newYork), width: 23 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		calendar := &calendarBucket{unit: tt.unit, weekStart: tt.weekStart, location: tt.location}
+		floor := calendar.floor(tt.at)
+		if !floor.Equal(tt.floor) {
+			t.Errorf("%s: floor %v, want %v", tt.name, floor, tt.floor)
+			continue
+		}
+		if width := calendar.next(floor).Sub(floor); width != tt.width {
+			t.Errorf("%s: bucket of %v, want %v", tt.name, width, tt.width)
+		}
+	}
+}
+
+func TestUnixEpochGroupTimestamps(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Unix(1700000000, 0)
+	query := backend.DataQuery{
+		Interval:  time.Minute,
+		TimeRange: backend.TimeRange{From: from, To: from.Add(time.Hour)},
+	}
+	rawSql := "SELECT $__unixEpochGroupAlias(ts, '10m'), AVG(v) AS value FROM t GROUP BY 1 ORDER BY 1"
+	sql, macros, err := sanitizeAndInterpolateMacros(rawSql, query, "", config, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `SELECT FLOOR(ts / 600)::INTEGER * 600 AS "time", AVG(v) AS value FROM t GROUP BY 1 ORDER BY 1`
+	if sql != want {
+		t.Fatalf("got %s, want %s", sql, want)
+	}
+	qm := queryModel{Format: formatTimeSeries}
+	if err := applyMacroState(&qm, macros); err != nil {
+		t.Fatal(err)
+	}
+	if qm.TimeColumnType != epochUnitSeconds {
+		t.Errorf("time column type %q, want %q", qm.TimeColumnType, epochUnitSeconds)
+	}
+
+	// what Vertica returns for the expanded query: INTEGER epoch seconds
+	result := fakeResult{columns: []fakeColumn{{name: "time", typeName: "integer"}, {name: "value", typeName: "float"}}}
+	var wantTimes []time.Time
+	for _, ts := range []int64{1700000000, 1700000700, 1700001900} {
+		bucket := ts / 600 * 600
+		result.rows = append(result.rows, []driver.Value{bucket, 1.0})
+		wantTimes = append(wantTimes, time.Unix(bucket, 0))
+	}
+	times := frameTimes(t, buildFakeTimeSeries(t, result, qm, query.TimeRange)[0])
+	if len(times) != len(wantTimes) {
+		t.Fatalf("got %v, want %v", times, wantTimes)
+	}
+	for i := range wantTimes {
+		if !times[i].Equal(wantTimes[i]) {
+			t.Errorf("point %d at %v, want %v", i, times[i], wantTimes[i])
+		}
+	}
+
+	// a declared unit wins over the macro's
+	qm = queryModel{Format: formatTimeSeries, TimeColumnType: "ms"}
+	if err := applyMacroState(&qm, macros); err != nil {
+		t.Fatal(err)
+	}
+	if qm.TimeColumnType != "ms" {
+		t.Errorf("declared time column type replaced by %q", qm.TimeColumnType)
+	}
+}
+
+func TestTimeFilterOffset(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		from     time.Time
+		shift    string
+		location *time.Location
+		want     string
+	}{
+		{
+			name:     "a week across the start of DST is 167 hours",
+			from:     time.Date(2024, 4, 2, 10, 0, 0, 0, berlin),
+			shift:    "7d",
+			location: berlin,
+			want:     "ts BETWEEN '2024-03-26T10:00:00+01:00' AND '2024-03-26T11:00:00+01:00'",
+		},
+		{
+			name:     "a week across the end of DST is 169 hours",
+			from:     time.Date(2024, 10, 29, 10, 0, 0, 0, berlin),
+			shift:    "7d",
+			location: berlin,
+			want:     "ts BETWEEN '2024-10-22T10:00:00+02:00' AND '2024-10-22T11:00:00+02:00'",
+		},
+		{
+			name:     "a duration ignores DST",
+			from:     time.Date(2024, 4, 2, 10, 0, 0, 0, berlin),
+			shift:    "168h",
+			location: berlin,
+			want:     "ts BETWEEN '2024-03-26T09:00:00+01:00' AND '2024-03-26T10:00:00+01:00'",
+		},
+		{
+			name:     "a week in UTC",
+			from:     time.Date(2024, 4, 2, 10, 0, 0, 0, time.UTC),
+			shift:    "'7d'",
+			location: time.UTC,
+			want:     "ts BETWEEN '2024-03-26T10:00:00Z' AND '2024-03-26T11:00:00Z'",
+		},
+	}
+	for _, tt := range tests {
+		query := backend.DataQuery{
+			Interval:  time.Minute,
+			TimeRange: backend.TimeRange{From: tt.from, To: tt.from.Add(time.Hour)},
+		}
+		sql, macros, err := sanitizeAndInterpolateMacros("$__timeFilterOffset(ts, "+tt.shift+")", query, "", config, tt.location)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if sql != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, sql, tt.want)
+		}
+
+		// the shifted rows are moved forward again onto the dashboard range
+		qm := queryModel{UnshiftTime: true}
+		if err := applyMacroState(&qm, macros); err != nil {
+			t.Fatal(err)
+		}
+		shifted := macros.timeShift.back(tt.from)
+		result := fakeResult{
+			columns: []fakeColumn{{name: "time", typeName: "timestamp"}, {name: "value", typeName: "float"}},
+			rows:    [][]driver.Value{{shifted, 1.0}},
+		}
+		times := frameTimes(t, buildFakeTimeSeries(t, result, qm, query.TimeRange)[0])
+		if len(times) != 1 || !times[0].Equal(tt.from) {
+			t.Errorf("%s: unshifted %v to %v, want %v", tt.name, shifted, times, tt.from)
+		}
+	}
+}
@@ -36,10 +36,26 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	if err := datasource.Serve(newDatasource()); err != nil {
+	ds := &VerticaDatasource{}
+
+	// Grafana normally stops the plugin through Serve, a signal would skip
+	// closing the sessions of the pools
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ds.dispose()
+		os.Exit(0)
+	}()
+
+	err := datasource.Serve(newDatasource(ds))
+	ds.dispose()
+	if err != nil {
 		log.DefaultLogger.Error(err.Error())
 		os.Exit(1)
 	}
@@ -0,0 +1,136 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxRetries bounds the retries of a transient error, retryBackoff is the
+// wait before the first one, doubled for each next.
+const (
+	maxRetries   = 2
+	retryBackoff = 100 * time.Millisecond
+)
+
+// isSessionLimitError reports whether err is Vertica rejecting a new session
+// because the cluster or the user reached its session limit.
+func isSessionLimitError(err error) bool {
+	return strings.Contains(err.Error(), "New session rejected due to limit")
+}
+
+// sessionLimitError replaces the error of a session Vertica rejected.
+func sessionLimitError(err error, config *configArgs) error {
+	return fmt.Errorf("Vertica rejected a new session because its session limit is reached, "+
+		"consider lowering maxOpenConnections of the datasource (currently %d): %v", config.MaxOpenConnections, err)
+}
+
+// isTransientError reports whether err means the server could not be reached
+// or dropped the connection, which a restarting node does for a moment. A
+// rejected session is transient too, other sessions may end meanwhile.
+func isTransientError(err error) bool {
+	if isSessionLimitError(err) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// the driver formats dial errors into a new error
+	return strings.HasPrefix(err.Error(), "cannot connect to ")
+}
+
+// retryTransient calls try until it succeeds, fails with an error that isn't
+// transient or maxRetries retries were made, waiting a jittered exponential
+// backoff between calls. It returns the number of retries made.
+func retryTransient(ctx context.Context, try func() error) (int, error) {
+	retries := 0
+	for {
+		err := try()
+		if err != nil && isSessionLimitError(err) {
+			rejectedSessions.Inc()
+		}
+		if err == nil || retries == maxRetries || !isTransientError(err) {
+			return retries, err
+		}
+		backoff := retryBackoff << uint(retries)
+		backoff += time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return retries, err
+		}
+		retries++
+	}
+}
+
+// openSession takes a connection from db and prepares its session, setting
+// timezone unless empty. It returns the connection and the session id.
+// A connection failing here is dropped from the pool rather than reused.
+func openSession(ctx context.Context, db *sql.DB, timezone string) (*sql.Conn, string, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if timezone != "" {
+		if _, err = conn.ExecContext(ctx, fmt.Sprintf("SET TIMEZONE TO %s", quoteLiteral(timezone))); err != nil {
+			discardConn(conn, err)
+			return nil, "", err
+		}
+	}
+	session, err := currentSession(ctx, conn)
+	if err != nil {
+		discardConn(conn, err)
+		return nil, "", err
+	}
+	return conn, session, nil
+}
+
+// discardConn closes conn, dropping it from the pool when err is transient.
+func discardConn(conn *sql.Conn, err error) {
+	if isTransientError(err) {
+		conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+	conn.Close()
+}
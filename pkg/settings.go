@@ -0,0 +1,278 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const defaultSeriesLimit = 1000
+
+// defaultMaxCellChars limits VARCHAR values unless configured otherwise.
+const defaultMaxCellChars = 4096
+
+// Connection pool limits used unless configured otherwise.
+const (
+	defaultMaxOpenConnections     = 5
+	defaultMaxIdleConnections     = 2
+	defaultConnMaxLifetimeSeconds = 14400
+	defaultConnMaxIdleTimeSeconds = 1800
+)
+
+// defaultConnectionTimeoutSeconds bounds reaching the server unless configured otherwise.
+const defaultConnectionTimeoutSeconds = 10
+
+// TLS modes of the Vertica driver.
+const (
+	tlsModeNone         = "none"
+	tlsModeServer       = "server"
+	tlsModeServerStrict = "server-strict"
+)
+
+// connectionParameterPattern matches the keys of connectionParameters.
+var connectionParameterPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// managedConnectionParameters are the DSN parameters the plugin sets itself.
+var managedConnectionParameters = map[string]bool{
+	"user":     true,
+	"password": true,
+	"database": true,
+	"tlsmode":  true,
+}
+
+// timestampZoneServer reads naive TIMESTAMP values in the server timezone.
+const timestampZoneServer = "server"
+
+const (
+	weekStartMonday = "monday"
+	weekStartSunday = "sunday"
+)
+
+const (
+	nonFiniteModeNull   = "null"
+	nonFiniteModeString = "string"
+)
+
+// jsonInt is an integer option of jsonData. Older versions of the config
+// editor saved it as a string, which it accepts too, empty meaning 0.
+type jsonInt int
+
+func (i *jsonInt) UnmarshalJSON(b []byte) error {
+	text := string(b)
+	if strings.HasPrefix(text, `"`) {
+		if err := json.Unmarshal(b, &text); err != nil {
+			return err
+		}
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || text == "null" {
+		*i = 0
+		return nil
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", b)
+	}
+	*i = jsonInt(n)
+	return nil
+}
+
+// configArgs holds the datasource options stored in jsonData.
+type configArgs struct {
+	SeriesLimit              int               `json:"seriesLimit"`
+	AutoSortTimeSeries       bool              `json:"autoSortTimeSeries"`
+	NonFiniteFloats          string            `json:"nonFiniteFloats"`
+	TimeAsString             bool              `json:"timeAsString"`
+	Timezone                 string            `json:"timezone"`
+	SnapTimeRange            bool              `json:"snapTimeRange"`
+	WeekStart                string            `json:"weekStart"`
+	TimeSlice                bool              `json:"timeSlice"`
+	NumericAsString          bool              `json:"numericAsString"`
+	BigIntAsString           bool              `json:"bigIntAsString"`
+	BinaryFormat             string            `json:"binaryFormat"`
+	BinaryMaxBytes           int               `json:"binaryMaxBytes"`
+	IntervalAsString         bool              `json:"intervalAsString"`
+	TimestampZone            string            `json:"timestampZone"`
+	MaxCellChars             int               `json:"maxCellChars"`
+	TrimCharPadding          *bool             `json:"trimCharPadding"`
+	GeoAsText                bool              `json:"geoAsText"`
+	MaxOpenConnections       int               `json:"maxOpenConnections"`
+	MaxIdleConnections       int               `json:"maxIdleConnections"`
+	ConnMaxLifetimeSeconds   int               `json:"connMaxLifetimeSeconds"`
+	ConnMaxIdleTimeSeconds   int               `json:"connMaxIdleTimeSeconds"`
+	TLSMode                  string            `json:"tlsmode"`
+	TLSSkipVerify            bool              `json:"tlsSkipVerify"`
+	QueryTimeoutSeconds      jsonInt           `json:"queryTimeoutSeconds"`
+	ConnectionTimeoutSeconds jsonInt           `json:"connectionTimeoutSeconds"`
+	MaxConcurrentQueries     int               `json:"maxConcurrentQueries"`
+	Subcluster               string            `json:"subcluster"`
+	ConnectionParameters     map[string]string `json:"connectionParameters"`
+	MinIdleConnections       int               `json:"minIdleConnections"`
+
+	// timestampLocation is TimestampZone resolved, nil for the server zone.
+	timestampLocation *time.Location
+}
+
+// loadConfigArgs reads the jsonData of a datasource instance and applies defaults.
+func loadConfigArgs(settings *backend.DataSourceInstanceSettings) (*configArgs, error) {
+	args := &configArgs{}
+	if settings != nil && len(settings.JSONData) > 0 {
+		if err := json.Unmarshal(settings.JSONData, args); err != nil {
+			return nil, err
+		}
+	}
+
+	if args.SeriesLimit <= 0 {
+		args.SeriesLimit = defaultSeriesLimit
+	}
+	switch args.NonFiniteFloats {
+	case "":
+		args.NonFiniteFloats = nonFiniteModeNull
+	case nonFiniteModeNull, nonFiniteModeString:
+	default:
+		return nil, fmt.Errorf("unsupported nonFiniteFloats mode: %s", args.NonFiniteFloats)
+	}
+
+	switch strings.ToLower(args.TimestampZone) {
+	case "", timestampZoneServer:
+	case "utc":
+		args.timestampLocation = time.UTC
+	default:
+		location, err := time.LoadLocation(args.TimestampZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestampZone %q", args.TimestampZone)
+		}
+		args.timestampLocation = location
+	}
+	switch args.BinaryFormat {
+	case "":
+		args.BinaryFormat = binaryFormatHex
+	case binaryFormatHex, binaryFormatBase64:
+	default:
+		return nil, fmt.Errorf("unsupported binaryFormat: %s", args.BinaryFormat)
+	}
+	if args.TrimCharPadding == nil {
+		trim := true
+		args.TrimCharPadding = &trim
+	}
+	if args.MaxCellChars == 0 {
+		args.MaxCellChars = defaultMaxCellChars
+	}
+	if args.BinaryMaxBytes == 0 {
+		args.BinaryMaxBytes = defaultBinaryMaxBytes
+	}
+	if args.MaxOpenConnections <= 0 {
+		args.MaxOpenConnections = defaultMaxOpenConnections
+	}
+	if args.MaxIdleConnections <= 0 {
+		args.MaxIdleConnections = defaultMaxIdleConnections
+	}
+	if args.MinIdleConnections > args.MaxIdleConnections {
+		// the pool would close the connections above its idle limit
+		args.MinIdleConnections = args.MaxIdleConnections
+	}
+	if args.MaxConcurrentQueries <= 0 {
+		args.MaxConcurrentQueries = args.MaxOpenConnections
+	}
+	if args.ConnMaxLifetimeSeconds <= 0 {
+		args.ConnMaxLifetimeSeconds = defaultConnMaxLifetimeSeconds
+	}
+	if args.ConnMaxIdleTimeSeconds <= 0 {
+		args.ConnMaxIdleTimeSeconds = defaultConnMaxIdleTimeSeconds
+	}
+	if args.ConnectionTimeoutSeconds <= 0 {
+		args.ConnectionTimeoutSeconds = defaultConnectionTimeoutSeconds
+	}
+	for key := range args.ConnectionParameters {
+		if !connectionParameterPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid connection parameter %q", key)
+		}
+		if managedConnectionParameters[strings.ToLower(key)] {
+			return nil, fmt.Errorf("connection parameter %q is set by the datasource settings", key)
+		}
+	}
+	switch args.TLSMode {
+	case "":
+		args.TLSMode = tlsModeNone
+	case tlsModeNone, tlsModeServer, tlsModeServerStrict:
+	default:
+		return nil, fmt.Errorf("unsupported tlsmode: %s", args.TLSMode)
+	}
+	switch args.WeekStart {
+	case "":
+		args.WeekStart = weekStartMonday
+	case weekStartMonday, weekStartSunday:
+	default:
+		return nil, fmt.Errorf("unsupported weekStart: %s", args.WeekStart)
+	}
+
+	return args, nil
+}
+
+// configurePool applies the connection pool limits to db.
+func (args *configArgs) configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(args.MaxOpenConnections)
+	db.SetMaxIdleConns(args.MaxIdleConnections)
+	db.SetConnMaxLifetime(time.Duration(args.ConnMaxLifetimeSeconds) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(args.ConnMaxIdleTimeSeconds) * time.Second)
+}
+
+// connectionTimeout returns ConnectionTimeoutSeconds as a duration.
+func (args *configArgs) connectionTimeout() time.Duration {
+	return time.Duration(args.ConnectionTimeoutSeconds) * time.Second
+}
+
+// driverTLSMode returns the tlsmode passed to the driver. Skipping verification
+// encrypts in the server mode, the one mode that does not verify the server.
+func (args *configArgs) driverTLSMode() string {
+	if args.TLSSkipVerify {
+		return tlsModeServer
+	}
+	return args.TLSMode
+}
+
+// weekStartDay returns the first day of calendar week buckets.
+func (args *configArgs) weekStartDay() time.Weekday {
+	if args.WeekStart == weekStartSunday {
+		return time.Sunday
+	}
+	return time.Monday
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestLoadConfigArgsQueryTimeout(t *testing.T) {
+	tests := []struct {
+		jsonData string
+		want     int
+		wantErr  bool
+	}{
+		{jsonData: `{}`, want: 0},
+		{jsonData: `{"queryTimeoutSeconds":30}`, want: 30},
+		{jsonData: `{"queryTimeoutSeconds":"30"}`, want: 30},
+		{jsonData: `{"queryTimeoutSeconds":""}`, want: 0},
+		{jsonData: `{"queryTimeoutSeconds":null}`, want: 0},
+		{jsonData: `{"queryTimeoutSeconds":"soon"}`, wantErr: true},
+		{jsonData: `{"queryTimeoutSeconds":1.5}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(tt.jsonData)})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.jsonData)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.jsonData, err)
+			continue
+		}
+		if int(config.QueryTimeoutSeconds) != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.jsonData, config.QueryTimeoutSeconds, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigArgsConnectionTimeout(t *testing.T) {
+	tests := []struct {
+		jsonData string
+		want     int
+	}{
+		{jsonData: `{}`, want: defaultConnectionTimeoutSeconds},
+		{jsonData: `{"connectionTimeoutSeconds":3}`, want: 3},
+		{jsonData: `{"connectionTimeoutSeconds":"3"}`, want: 3},
+		{jsonData: `{"connectionTimeoutSeconds":""}`, want: defaultConnectionTimeoutSeconds},
+	}
+	for _, tt := range tests {
+		config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(tt.jsonData)})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.jsonData, err)
+			continue
+		}
+		if int(config.ConnectionTimeoutSeconds) != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.jsonData, config.ConnectionTimeoutSeconds, tt.want)
+		}
+	}
+}
@@ -0,0 +1,879 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// metricColumn is the name of the column whose values name the series.
+const metricColumn = "metric"
+
+const (
+	epochUnitAuto         = ""
+	epochUnitSeconds      = "s"
+	epochUnitMilliseconds = "ms"
+	epochUnitMicroseconds = "us"
+	epochUnitNanoseconds  = "ns"
+	timeColumnTypeString  = "string"
+)
+
+// defaultTimeLayouts are tried in order when parsing string time columns
+// without a layout of their own.
+var defaultTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05"}
+
+// epochMillisecondsThreshold is the magnitude from which an epoch without an
+// explicit unit is taken as milliseconds. As seconds it would be year 5138.
+// Each following threshold is three orders of magnitude larger.
+const (
+	epochMillisecondsThreshold = 1e11
+	epochMicrosecondsThreshold = 1e14
+	epochNanosecondsThreshold  = 1e17
+)
+
+// epochUnits maps the epoch units to their duration.
+var epochUnits = map[string]time.Duration{
+	epochUnitSeconds:      time.Second,
+	epochUnitMilliseconds: time.Millisecond,
+	epochUnitMicroseconds: time.Microsecond,
+	epochUnitNanoseconds:  time.Nanosecond,
+}
+
+// parseTimeColumnType normalizes the timeColumnType of a query, which is either
+// the unit of a numeric epoch column or string for formatted timestamps.
+func parseTimeColumnType(unit string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(unit)) {
+	case "", "auto":
+		return epochUnitAuto, nil
+	case "s", "seconds":
+		return epochUnitSeconds, nil
+	case "ms", "milliseconds":
+		return epochUnitMilliseconds, nil
+	case "us", "microseconds":
+		return epochUnitMicroseconds, nil
+	case "ns", "nanoseconds":
+		return epochUnitNanoseconds, nil
+	case timeColumnTypeString:
+		return timeColumnTypeString, nil
+	default:
+		return "", fmt.Errorf("unsupported time column type: %s", unit)
+	}
+}
+
+// resolveEpochUnit returns the epoch unit for the timeColumnType of a query,
+// or fallback when the query declares none.
+func resolveEpochUnit(timeColumnType string, fallback string) (string, error) {
+	if strings.TrimSpace(timeColumnType) == "" {
+		return fallback, nil
+	}
+	return parseTimeColumnType(timeColumnType)
+}
+
+// epochTimeColumns turns the INTEGER columns named time into time columns,
+// reading them in the unit resolveEpochUnit gives for timeColumnType and
+// fallback. Time series pick their time column themselves and don't need this.
+func epochTimeColumns(fields []*data.Field, converters []func(interface{}) interface{}, colTypes []*sql.ColumnType, timeColumnType string, fallback string) error {
+	for i, colType := range colTypes {
+		if colType.DatabaseTypeName() != "integer" || fields[i].Name != "time" || fields[i].Type() != data.FieldTypeNullableFloat64 {
+			continue
+		}
+		unit, err := resolveEpochUnit(timeColumnType, fallback)
+		if err != nil {
+			return err
+		}
+		if unit == timeColumnTypeString {
+			continue
+		}
+		config := fields[i].Config
+		fields[i] = data.NewField(fields[i].Name, fields[i].Labels, make([]*time.Time, 0))
+		fields[i].Config = config
+		convert := converters[i]
+		converters[i] = func(raw interface{}) interface{} {
+			epoch, ok := convert(raw).(*float64)
+			if !ok || epoch == nil {
+				return nil
+			}
+			t := epochToTime(*epoch, unit)
+			return &t
+		}
+	}
+	return nil
+}
+
+// epochToTime converts an epoch in the given unit to a time. Without a unit,
+// the unit is told apart by magnitude. Fractions are kept.
+func epochToTime(epoch float64, unit string) time.Time {
+	if unit == epochUnitAuto {
+		switch magnitude := math.Abs(epoch); {
+		case magnitude >= epochNanosecondsThreshold:
+			unit = epochUnitNanoseconds
+		case magnitude >= epochMicrosecondsThreshold:
+			unit = epochUnitMicroseconds
+		case magnitude >= epochMillisecondsThreshold:
+			unit = epochUnitMilliseconds
+		default:
+			unit = epochUnitSeconds
+		}
+	}
+	// the whole units are converted apart from the fraction, a float64 holds
+	// too few digits for the nanoseconds of a current epoch
+	whole := math.Floor(epoch)
+	scale := epochUnits[unit]
+	return time.Unix(0, int64(whole)*int64(scale)+int64(math.Round((epoch-whole)*float64(scale))))
+}
+
+// parseTimePrecision returns the precision the times of a query are emitted
+// with, 0 for full precision. Times are emitted in milliseconds, as they always
+// were, unless a query opts into a finer precision.
+func parseTimePrecision(precision string) (time.Duration, error) {
+	switch strings.ToLower(strings.TrimSpace(precision)) {
+	case "ns", "nanoseconds":
+		return 0, nil
+	case "us", "microseconds":
+		return time.Microsecond, nil
+	case "", "ms", "milliseconds":
+		return time.Millisecond, nil
+	default:
+		return 0, fmt.Errorf("unsupported time precision: %s", precision)
+	}
+}
+
+// toTime returns the time held by a converted time column value, which is
+// either a time, a numeric epoch or a string in one of layouts.
+func toTime(value interface{}, unit string, layouts []string) (time.Time, bool) {
+	switch v := value.(type) {
+	case *time.Time:
+		return *v, true
+	case *float64:
+		return epochToTime(*v, unit), true
+	case *string:
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(*v)); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	default:
+		return time.Time{}, false
+	}
+}
+
+// maxSortPoints bounds the size of series that are sorted when rows do not
+// come back in time order.
+const maxSortPoints = 1000000
+
+// timeSeries holds the points of a single series while rows are being scanned.
+type timeSeries struct {
+	name        string
+	displayName string
+	config      data.FieldConfig
+	labels      data.Labels
+	times       []time.Time
+	values      []*float64
+	unordered   bool
+}
+
+func (s *timeSeries) append(t time.Time, value *float64) {
+	if n := len(s.times); n > 0 && t.Before(s.times[n-1]) {
+		s.unordered = true
+	}
+	s.times = append(s.times, t)
+	s.values = append(s.values, value)
+}
+
+// sort orders the points of s by time, keeping the row order of equal times.
+func (s *timeSeries) sort() {
+	order := make([]int, len(s.times))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return s.times[order[i]].Before(s.times[order[j]])
+	})
+
+	times := make([]time.Time, len(order))
+	values := make([]*float64, len(order))
+	for i, from := range order {
+		times[i] = s.times[from]
+		values[i] = s.values[from]
+	}
+	s.times = times
+	s.values = values
+	s.unordered = false
+}
+
+func (s *timeSeries) toFrame() *data.Frame {
+	valueField := data.NewField(s.name, s.labels, s.values)
+	config := s.config
+	if s.displayName != "" {
+		config.DisplayName = s.displayName
+	}
+	if config.DisplayName != "" || config.Unit != "" || config.Decimals != nil {
+		valueField.Config = &config
+	}
+	return data.NewFrame(s.name,
+		data.NewField("time", nil, s.times),
+		valueField,
+	)
+}
+
+var aliasPattern = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// formatAlias replaces the {{name}} placeholders of alias with the matching
+// entry of vars. Unknown placeholders are kept as they are.
+func formatAlias(alias string, vars map[string]string) string {
+	return aliasPattern.ReplaceAllStringFunc(alias, func(placeholder string) string {
+		name := aliasPattern.FindStringSubmatch(placeholder)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// seriesSet keeps the series of a result in the order they were first seen.
+// Series are keyed by their name and labels. Once limit series exist, new
+// series are dropped and only counted.
+type seriesSet struct {
+	byName  map[string]*timeSeries
+	order   []*timeSeries
+	limit   int
+	dropped map[string]struct{}
+}
+
+func newSeriesSet(limit int) *seriesSet {
+	return &seriesSet{
+		byName:  make(map[string]*timeSeries),
+		limit:   limit,
+		dropped: make(map[string]struct{}),
+	}
+}
+
+// get returns the series for name and labels, creating it if needed, and
+// whether it was created. Hidden labels only take part in telling series apart.
+// It returns nil when the series was dropped because of the series limit.
+func (ss *seriesSet) get(name string, labels, hidden data.Labels) (*timeSeries, bool) {
+	key := name
+	if len(labels) > 0 {
+		key += "\x00" + labels.String()
+	}
+	if len(hidden) > 0 {
+		key += "\x00\x00" + hidden.String()
+	}
+	s, ok := ss.byName[key]
+	if !ok {
+		if ss.limit > 0 && len(ss.order) >= ss.limit {
+			ss.dropped[key] = struct{}{}
+			return nil, false
+		}
+		s = &timeSeries{name: name, labels: labels}
+		ss.byName[key] = s
+		ss.order = append(ss.order, s)
+	}
+	return s, !ok
+}
+
+// seriesColumns describes the role of each column of a time series result.
+type seriesColumns struct {
+	time    int
+	metric  int
+	values  []int
+	labels  []int
+	hidden  []int
+	ignored []string
+}
+
+// findColumn returns the index of the field called name, ignoring case.
+func findColumn(fields []*data.Field, name string) (int, error) {
+	for i, field := range fields {
+		if strings.EqualFold(field.Name, name) {
+			return i, nil
+		}
+	}
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.Name
+	}
+	return -1, fmt.Errorf("column %q not found, available columns: %s", name, strings.Join(names, ", "))
+}
+
+// detectTimeColumn returns the index of the column aliased time if it holds
+// times, otherwise the first column holding times, or -1 when there is none.
+func detectTimeColumn(fields []*data.Field) int {
+	first := -1
+	for i, field := range fields {
+		if field.Type() != data.FieldTypeNullableTime {
+			continue
+		}
+		if strings.EqualFold(field.Name, "time") {
+			return i
+		}
+		if first == -1 {
+			first = i
+		}
+	}
+	return first
+}
+
+// isTimeColumnCandidate reports whether field can hold the time axis for the
+// declared time column type. Strings are only accepted when declared.
+func isTimeColumnCandidate(field *data.Field, timeColumnType string) bool {
+	switch field.Type() {
+	case data.FieldTypeNullableTime:
+		return true
+	case data.FieldTypeNullableFloat64:
+		return timeColumnType != timeColumnTypeString
+	case data.FieldTypeNullableString:
+		return timeColumnType == timeColumnTypeString
+	default:
+		return false
+	}
+}
+
+// fieldConfig returns a copy of the unit and decimals configured on field.
+func fieldConfig(field *data.Field) data.FieldConfig {
+	if field.Config == nil {
+		return data.FieldConfig{}
+	}
+	return data.FieldConfig{Unit: field.Config.Unit, Decimals: field.Config.Decimals}
+}
+
+// isValueColumn reports whether field can provide series values. Booleans are
+// plotted as 1 and 0.
+func isValueColumn(field *data.Field) bool {
+	t := field.Type()
+	return t == data.FieldTypeNullableFloat64 || t == data.FieldTypeNullableBool
+}
+
+// toFloat returns the series value of a converted value column.
+func toFloat(value interface{}) *float64 {
+	switch v := value.(type) {
+	case *float64:
+		return v
+	case *bool:
+		f := 0.0
+		if *v {
+			f = 1
+		}
+		return &f
+	default:
+		return nil
+	}
+}
+
+// detectSeriesColumns assigns the time, metric, value and label roles to the
+// columns of a result. Columns named in the query model take precedence over
+// detection by type. Binary columns never take a role and time of day columns
+// never hold the time axis.
+func detectSeriesColumns(fields []*data.Field, qm queryModel, binary map[int]bool, timeOfDay map[int]bool) (*seriesColumns, error) {
+	columns := &seriesColumns{time: -1, metric: -1}
+
+	var err error
+	if qm.TimeColumn != "" {
+		if columns.time, err = findColumn(fields, qm.TimeColumn); err != nil {
+			return nil, err
+		}
+		if binary[columns.time] || timeOfDay[columns.time] || !isTimeColumnCandidate(fields[columns.time], qm.TimeColumnType) {
+			return nil, fmt.Errorf("time column %q is not a timestamp or epoch column", qm.TimeColumn)
+		}
+	}
+	if qm.MetricColumn != "" {
+		if columns.metric, err = findColumn(fields, qm.MetricColumn); err != nil {
+			return nil, err
+		}
+		if fields[columns.metric].Type() != data.FieldTypeNullableString {
+			return nil, fmt.Errorf("metric column %q is not a string column", qm.MetricColumn)
+		}
+	}
+	if columns.time == -1 {
+		columns.time = detectTimeColumn(fields)
+	}
+	if columns.time == -1 {
+		// Numeric epochs and strings are only used when the column is aliased
+		// time or, failing that, when a matching time column type is declared.
+		for i, field := range fields {
+			if binary[i] || timeOfDay[i] || field.Type() == data.FieldTypeNullableTime || !isTimeColumnCandidate(field, qm.TimeColumnType) {
+				continue
+			}
+			if strings.EqualFold(field.Name, "time") {
+				columns.time = i
+				break
+			}
+			if columns.time == -1 && qm.TimeColumnType != "" {
+				columns.time = i
+			}
+		}
+	}
+	explicitValues := make(map[int]bool)
+	for _, name := range qm.ValueColumns {
+		i, err := findColumn(fields, name)
+		if err != nil {
+			return nil, err
+		}
+		if !isValueColumn(fields[i]) {
+			return nil, fmt.Errorf("value column %q is not a numeric column", name)
+		}
+		explicitValues[i] = true
+	}
+
+	for i, field := range fields {
+		switch {
+		case i == columns.time || i == columns.metric:
+		case binary[i]:
+			columns.ignored = append(columns.ignored, field.Name)
+		case isHiddenColumn(field.Name):
+			if field.Type() == data.FieldTypeNullableString {
+				columns.hidden = append(columns.hidden, i)
+			}
+		case field.Type() == data.FieldTypeNullableString && columns.metric == -1 && qm.MetricColumn == "" && strings.EqualFold(field.Name, metricColumn):
+			columns.metric = i
+		case isValueColumn(field) && (len(explicitValues) == 0 || explicitValues[i]):
+			columns.values = append(columns.values, i)
+		case field.Type() == data.FieldTypeNullableString:
+			columns.labels = append(columns.labels, i)
+		default:
+			columns.ignored = append(columns.ignored, field.Name)
+		}
+	}
+	if columns.time == -1 {
+		described := make([]string, len(fields))
+		for i, field := range fields {
+			described[i] = fmt.Sprintf("%s (%s)", field.Name, field.Type().ItemTypeString())
+		}
+		return nil, fmt.Errorf("no time column found in columns: %s", strings.Join(described, ", "))
+	}
+	if len(columns.values) == 0 {
+		return nil, errors.New("no numeric column found")
+	}
+
+	return columns, nil
+}
+
+// buildSeriesTimeSeriesResult converts rows into time series frames. The first
+// time column (timestamp or epoch) is used as the time axis and every other
+// numeric column becomes a series named after the column. When a string column
+// named metric is present, rows are grouped into one series per metric value.
+// Any other string column becomes a label of the series; empty and NULL label
+// values are left out of the labels. NaN and infinite values become NULL.
+//
+// The query's transform is applied to every series, then series with more
+// points than the query's MaxDataPoints are downsampled and missing interval
+// boundaries are filled according to the fill mode of the query. At most
+// config.SeriesLimit series are returned.
+func (v *VerticaDatasource) buildSeriesTimeSeriesResult(rows *sql.Rows, qm queryModel, query backend.DataQuery, config *configArgs) ([]*data.Frame, error) {
+	fillMode, err := parseFillMode(qm.Fill)
+	if err != nil {
+		return nil, err
+	}
+	aggregation, err := parseDownsampleAggregation(qm.Downsample)
+	if err != nil {
+		return nil, err
+	}
+	transform, err := parseTransform(qm.Transform)
+	if err != nil {
+		return nil, err
+	}
+	precision, err := parseTimePrecision(qm.TimePrecision)
+	if err != nil {
+		return nil, err
+	}
+	timeType, err := parseTimeColumnType(qm.TimeColumnType)
+	if err != nil {
+		return nil, err
+	}
+	timeLayouts := defaultTimeLayouts
+	if qm.TimeLayout != "" {
+		timeLayouts = []string{qm.TimeLayout}
+	}
+
+	options := newFieldOptions(config, qm)
+	fields, converters, err := buildFields(rows, options)
+	if err != nil {
+		return nil, err
+	}
+
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := detectSeriesColumns(fields, qm, options.binary.columns, timeOfDayColumns(colTypes))
+	if err != nil {
+		return nil, err
+	}
+	timeIndex, metricIndex := columns.time, columns.metric
+	valueIndices, labelIndices, ignored := columns.values, columns.labels, columns.ignored
+	hiddenIndices := columns.hidden
+
+	series := newSeriesSet(config.SeriesLimit)
+	nullMetrics, unparsedTimes, nonFinite := 0, 0, 0
+
+	// Without grouping columns the series are known up front, so they are
+	// created even when no rows come back and can still be filled.
+	if metricIndex == -1 && len(labelIndices) == 0 && len(hiddenIndices) == 0 {
+		for _, valueIndex := range valueIndices {
+			s, _ := series.get(fields[valueIndex].Name, nil, nil)
+			if s != nil {
+				s.config = fieldConfig(fields[valueIndex])
+			}
+			if s != nil && qm.Alias != "" {
+				s.displayName = formatAlias(qm.Alias, map[string]string{"column": fields[valueIndex].Name})
+			}
+		}
+	}
+
+	err = scanRows(rows, converters, func(values []interface{}) error {
+		if values[timeIndex] == nil {
+			return nil
+		}
+		t, ok := toTime(values[timeIndex], timeType, timeLayouts)
+		if !ok {
+			unparsedTimes++
+			return nil
+		}
+
+		metric := ""
+		if metricIndex != -1 {
+			if values[metricIndex] == nil {
+				nullMetrics++
+				return nil
+			}
+			metric = *values[metricIndex].(*string)
+		}
+
+		var labels data.Labels
+		for _, labelIndex := range labelIndices {
+			label, ok := values[labelIndex].(*string)
+			if !ok || *label == "" {
+				continue
+			}
+			if labels == nil {
+				labels = data.Labels{}
+			}
+			labels[fields[labelIndex].Name] = *label
+		}
+
+		var hidden data.Labels
+		for _, hiddenIndex := range hiddenIndices {
+			if value, ok := values[hiddenIndex].(*string); ok {
+				if hidden == nil {
+					hidden = data.Labels{}
+				}
+				hidden[fields[hiddenIndex].Name] = *value
+			}
+		}
+
+		for _, valueIndex := range valueIndices {
+			name := fields[valueIndex].Name
+			if metricIndex != -1 {
+				name = metric
+				if len(valueIndices) > 1 {
+					name += " " + fields[valueIndex].Name
+				}
+			}
+			s, created := series.get(name, labels, hidden)
+			if s == nil {
+				continue
+			}
+			if created {
+				s.config = fieldConfig(fields[valueIndex])
+			}
+			if created && qm.Alias != "" {
+				vars := map[string]string{"column": fields[valueIndex].Name}
+				if metricIndex != -1 {
+					vars[metricColumn] = metric
+				}
+				for _, labelIndex := range labelIndices {
+					vars[fields[labelIndex].Name] = labels[fields[labelIndex].Name]
+				}
+				for _, hiddenIndex := range hiddenIndices {
+					vars[fields[hiddenIndex].Name] = hidden[fields[hiddenIndex].Name]
+				}
+				s.displayName = formatAlias(qm.Alias, vars)
+			}
+			value := toFloat(values[valueIndex])
+			if value != nil && (math.IsNaN(*value) || math.IsInf(*value, 0)) {
+				value = nil
+				nonFinite++
+			}
+			s.append(t, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &data.FrameMeta{
+		ExecutedQueryString: qm.RawSQL,
+		Custom: map[string]interface{}{
+			"columns":    columnsMeta(colTypes, fields),
+			"timeColumn": fields[timeIndex].Name,
+		},
+	}
+	if len(options.renamedColumns) > 0 {
+		meta.Custom["renamedColumns"] = options.renamedColumns
+	}
+	if len(options.unknownTypes) > 0 {
+		meta.Custom["unknownTypes"] = options.unknownTypes
+	}
+	if len(ignored) > 0 {
+		meta.Custom["ignoredColumns"] = ignored
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("columns of unsupported type ignored: %s", strings.Join(ignored, ", ")),
+		})
+	}
+	if nullMetrics > 0 {
+		meta.Custom["nullMetricRows"] = nullMetrics
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d rows with a NULL metric were skipped", nullMetrics),
+		})
+	}
+
+	var boolColumns []string
+	for _, valueIndex := range valueIndices {
+		if fields[valueIndex].Type() == data.FieldTypeNullableBool {
+			boolColumns = append(boolColumns, fields[valueIndex].Name)
+		}
+	}
+	if len(boolColumns) > 0 {
+		meta.Custom["booleanColumns"] = map[string]interface{}{
+			"columns": boolColumns,
+			"true":    1,
+			"false":   0,
+		}
+	}
+	if nonFinite > 0 {
+		meta.Custom["nonFiniteValues"] = nonFinite
+	}
+	if hiddenColumns := hiddenColumnNames(fields); len(hiddenColumns) > 0 {
+		meta.Custom["hiddenColumns"] = hiddenColumns
+	}
+	if unparsedTimes > 0 {
+		meta.Custom["unparsedTimes"] = unparsedTimes
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d rows with an unparseable time were skipped", unparsedTimes),
+		})
+	}
+	if len(series.dropped) > 0 {
+		meta.Custom["seriesTruncated"] = len(series.dropped)
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d series truncated, the limit is %d series", len(series.dropped), config.SeriesLimit),
+		})
+	}
+
+	fillInterval := queryInterval(query)
+	if qm.fillInterval > 0 {
+		fillInterval = qm.fillInterval
+	}
+
+	bucket := downsampleBucket(query.TimeRange, query.Interval, query.MaxDataPoints)
+	downsampled, originalPoints := 0, 0
+
+	sorted, unordered := 0, 0
+	for _, s := range series.order {
+		if !s.unordered {
+			continue
+		}
+		if config.AutoSortTimeSeries && len(s.times) <= maxSortPoints {
+			s.sort()
+			sorted++
+		} else {
+			unordered++
+		}
+	}
+	if sorted > 0 {
+		meta.Custom["sortedSeries"] = sorted
+	}
+	if unordered > 0 {
+		meta.Custom["unorderedSeries"] = unordered
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d series are not ordered by time, add ORDER BY to the query", unordered),
+		})
+	}
+
+	fillRange := query.TimeRange
+	if qm.timeShift != nil {
+		if qm.UnshiftTime {
+			meta.Custom["unshiftedTime"] = true
+		} else {
+			fillRange = backend.TimeRange{From: qm.timeShift.back(fillRange.From), To: qm.timeShift.back(fillRange.To)}
+		}
+	}
+
+	frames := make([]*data.Frame, 0, len(series.order))
+	fillCapped := 0
+	for _, s := range series.order {
+		if qm.timeShift != nil && qm.UnshiftTime {
+			for i, t := range s.times {
+				s.times[i] = qm.timeShift.forward(t)
+			}
+		}
+		s.transform(transform)
+		points := len(s.times)
+		if s.downsample(aggregation, bucket, query.MaxDataPoints) {
+			downsampled++
+			originalPoints += points
+		}
+		if s.fill(fillMode, fillRange, fillInterval, qm.fillOffset, qm.fillCalendar) {
+			fillCapped++
+		}
+		s.markGaps(qm.GapThreshold, query.Interval)
+		// Points are ordered and grouped at full precision, only the
+		// emitted times are coarsened.
+		if precision > 0 {
+			for i, t := range s.times {
+				s.times[i] = t.Truncate(precision)
+			}
+		}
+		frames = append(frames, s.toFrame())
+	}
+	if len(frames) == 0 {
+		frames = append(frames, data.NewFrame("results"))
+	}
+
+	if fillCapped > 0 {
+		meta.Custom["fillTruncated"] = fillCapped
+		meta.Notices = append(meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d series were filled with the limit of %d points, use a wider fill interval", fillCapped, maxFillPoints),
+		})
+	}
+	if downsampled > 0 {
+		meta.Custom["downsampling"] = map[string]interface{}{
+			"aggregation":    aggregation,
+			"bucket":         bucket.String(),
+			"series":         downsampled,
+			"originalPoints": originalPoints,
+		}
+	}
+	frames[0].Meta = meta
+
+	return frames, nil
+}
+
+// pivotWide turns a long (time, metric, value) table into one row per
+// timestamp and one column per metric. Timestamps missing a metric get a NULL
+// in that metric's column and rows are ordered chronologically.
+func pivotWide(frame *data.Frame) (*data.Frame, error) {
+	timeIndex, metricIndex, valueIndex := detectTimeColumn(frame.Fields), -1, -1
+	for i, field := range frame.Fields {
+		switch field.Type() {
+		case data.FieldTypeNullableString:
+			if metricIndex == -1 || strings.EqualFold(field.Name, metricColumn) {
+				metricIndex = i
+			}
+		case data.FieldTypeNullableFloat64:
+			if valueIndex == -1 {
+				valueIndex = i
+			}
+		}
+	}
+	if timeIndex == -1 || metricIndex == -1 || valueIndex == -1 {
+		return nil, errors.New("wide result shape requires a time, a metric and a numeric value column")
+	}
+
+	var times []time.Time
+	// keyed by instant, equal times in other locations share a row
+	timeRows := make(map[int64]int)
+	var metrics []string
+	columns := make(map[string]map[int]*float64)
+
+	for row := 0; row < frame.Rows(); row++ {
+		t, ok := frame.Fields[timeIndex].At(row).(*time.Time)
+		if !ok || t == nil {
+			continue
+		}
+		metric := "null"
+		if m, ok := frame.Fields[metricIndex].At(row).(*string); ok && m != nil {
+			metric = *m
+		}
+
+		timeRow, ok := timeRows[t.UnixNano()]
+		if !ok {
+			timeRow = len(times)
+			timeRows[t.UnixNano()] = timeRow
+			times = append(times, *t)
+		}
+		column, ok := columns[metric]
+		if !ok {
+			column = make(map[int]*float64)
+			columns[metric] = column
+			metrics = append(metrics, metric)
+		}
+		value, _ := frame.Fields[valueIndex].At(row).(*float64)
+		column[timeRow] = value
+	}
+
+	order := make([]int, len(times))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return times[order[i]].Before(times[order[j]])
+	})
+
+	sortedTimes := make([]time.Time, len(times))
+	for i, timeRow := range order {
+		sortedTimes[i] = times[timeRow]
+	}
+
+	result := data.NewFrame(frame.Name, data.NewField(frame.Fields[timeIndex].Name, nil, sortedTimes))
+	for _, metric := range metrics {
+		values := make([]*float64, len(times))
+		for i, timeRow := range order {
+			values[i] = columns[metric][timeRow]
+		}
+		field := data.NewField(metric, nil, values)
+		field.Config = frame.Fields[valueIndex].Config
+		result.Fields = append(result.Fields, field)
+	}
+	result.Meta = frame.Meta
+
+	return result, nil
+}
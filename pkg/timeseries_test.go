@@ -0,0 +1,539 @@
+package main
+
+import (
+	"database/sql/driver"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func TestResolveEpochUnit(t *testing.T) {
+	tests := []struct {
+		timeColumnType string
+		fallback       string
+		want           string
+		wantErr        bool
+	}{
+		{timeColumnType: "", fallback: epochUnitMilliseconds, want: epochUnitMilliseconds},
+		{timeColumnType: " ", fallback: epochUnitAuto, want: epochUnitAuto},
+		{timeColumnType: "auto", fallback: epochUnitMilliseconds, want: epochUnitAuto},
+		{timeColumnType: "s", fallback: epochUnitMilliseconds, want: epochUnitSeconds},
+		{timeColumnType: "ns", fallback: epochUnitAuto, want: epochUnitNanoseconds},
+		{timeColumnType: "string", fallback: epochUnitAuto, want: timeColumnTypeString},
+		{timeColumnType: "fortnights", fallback: epochUnitAuto, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveEpochUnit(tt.timeColumnType, tt.fallback)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.timeColumnType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.timeColumnType, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q/%q: got %q, want %q", tt.timeColumnType, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestEpochToTime(t *testing.T) {
+	tests := []struct {
+		epoch float64
+		unit  string
+		want  time.Time
+	}{
+		{epoch: 0, unit: epochUnitMilliseconds, want: time.Unix(0, 0)},
+		{epoch: -1000, unit: epochUnitMilliseconds, want: time.Unix(-1, 0)},
+		{epoch: 1500, unit: epochUnitMilliseconds, want: time.Unix(1, 500*int64(time.Millisecond))},
+		// An hour after the epoch in ms would be read as seconds by magnitude.
+		{epoch: 3600000, unit: epochUnitMilliseconds, want: time.Unix(3600, 0)},
+		{epoch: 1700000000, unit: epochUnitSeconds, want: time.Unix(1700000000, 0)},
+		{epoch: 1700000000, unit: epochUnitAuto, want: time.Unix(1700000000, 0)},
+		{epoch: 1700000000.25, unit: epochUnitSeconds, want: time.Unix(1700000000, 250e6)},
+		{epoch: -0.5, unit: epochUnitSeconds, want: time.Unix(-1, 500e6)},
+		{epoch: 1700000000000, unit: epochUnitAuto, want: time.Unix(1700000000, 0)},
+		{epoch: 1700000000000000, unit: epochUnitAuto, want: time.Unix(1700000000, 0)},
+	}
+	for _, tt := range tests {
+		if got := epochToTime(tt.epoch, tt.unit); !got.Equal(tt.want) {
+			t.Errorf("%v %q: got %v, want %v", tt.epoch, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimePrecision(t *testing.T) {
+	tests := []struct {
+		precision string
+		want      time.Duration
+		wantErr   bool
+	}{
+		{precision: "", want: time.Millisecond},
+		{precision: "ms", want: time.Millisecond},
+		{precision: "Milliseconds", want: time.Millisecond},
+		{precision: "us", want: time.Microsecond},
+		{precision: " microseconds ", want: time.Microsecond},
+		{precision: "ns", want: 0},
+		{precision: "nanoseconds", want: 0},
+		{precision: "s", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimePrecision(tt.precision)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.precision)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.precision, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.precision, got, tt.want)
+		}
+	}
+}
+
+// buildFakeTimeSeries runs the time series builder on result for a query over
+// timeRange.
+func buildFakeTimeSeries(t *testing.T, result fakeResult, qm queryModel, timeRange backend.TimeRange) []*data.Frame {
+	t.Helper()
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qm.Format = formatTimeSeries
+	query := backend.DataQuery{TimeRange: timeRange, Interval: time.Minute, MaxDataPoints: 1000}
+	frames, err := (&VerticaDatasource{}).buildSeriesTimeSeriesResult(queryFake(t, &fakeConnector{result: result}), qm, query, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+// frameTimes returns the times of the time field of frame.
+func frameTimes(t *testing.T, frame *data.Frame) []time.Time {
+	t.Helper()
+	times := make([]time.Time, frame.Fields[0].Len())
+	for i := range times {
+		v, ok := frame.Fields[0].At(i).(time.Time)
+		if !ok {
+			t.Fatalf("time field holds %T", frame.Fields[0].At(i))
+		}
+		times[i] = v
+	}
+	return times
+}
+
+// frameValues returns the values of the value field of frame.
+func frameValues(t *testing.T, frame *data.Frame) []*float64 {
+	t.Helper()
+	values := make([]*float64, frame.Fields[1].Len())
+	for i := range values {
+		v, ok := frame.Fields[1].At(i).(*float64)
+		if !ok {
+			t.Fatalf("value field holds %T", frame.Fields[1].At(i))
+		}
+		values[i] = v
+	}
+	return values
+}
+
+// sameValues reports whether got holds the values of want, NaN standing for
+// NULL.
+func sameValues(got []*float64, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range want {
+		if math.IsNaN(want[i]) != (got[i] == nil) || got[i] != nil && *got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTimeSeriesValueColumns(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	result := fakeResult{
+		columns: []fakeColumn{
+			{name: "time", typeName: "timestamp"},
+			{name: "cpu_pct", typeName: "float"},
+			{name: "mem_pct", typeName: "integer"},
+			{name: "io_wait", typeName: "float"},
+			{name: "host", typeName: "binary"},
+		},
+		rows: [][]driver.Value{
+			{at(0), 12.5, int64(40), 0.5, []byte{1}},
+			{at(1), 13.5, nil, nil, []byte{2}},
+			{at(2), nil, int64(42), 1.5, []byte{3}},
+		},
+	}
+	frames := buildFakeTimeSeries(t, result, queryModel{}, backend.TimeRange{From: at(0), To: at(2)})
+	null := math.NaN()
+	want := []struct {
+		name   string
+		values []float64
+	}{
+		{name: "cpu_pct", values: []float64{12.5, 13.5, null}},
+		{name: "mem_pct", values: []float64{40, null, 42}},
+		{name: "io_wait", values: []float64{0.5, null, 1.5}},
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("got %d series, want %d", len(frames), len(want))
+	}
+	for i, w := range want {
+		if name := frames[i].Fields[1].Name; name != w.name {
+			t.Errorf("series %d named %s, want %s", i, name, w.name)
+		}
+		if got := frameValues(t, frames[i]); !sameValues(got, w.values) {
+			t.Errorf("%s: got %v, want %v", w.name, got, w.values)
+		}
+	}
+	if ignored := frames[0].Meta.Custom["ignoredColumns"]; !reflect.DeepEqual(ignored, []string{"host"}) {
+		t.Errorf("ignoredColumns: got %v, want [host]", ignored)
+	}
+}
+
+func TestTimeSeriesEpochTimeColumn(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Unix(1700000000, 0), To: time.Unix(1700003600, 0)}
+	tests := []struct {
+		name           string
+		typeName       string
+		timeColumnType string
+		epochs         []driver.Value
+		want           []time.Time
+	}{
+		{
+			name: "integer seconds", typeName: "integer",
+			epochs: []driver.Value{int64(1700000000), int64(1700000060)},
+			want:   []time.Time{time.Unix(1700000000, 0), time.Unix(1700000060, 0)},
+		},
+		{
+			name: "integer milliseconds", typeName: "integer",
+			epochs: []driver.Value{int64(1700000000000), int64(1700000060500)},
+			want:   []time.Time{time.Unix(1700000000, 0), time.Unix(1700000060, 500e6)},
+		},
+		{
+			name: "fractional seconds", typeName: "float",
+			epochs: []driver.Value{1700000000.25},
+			want:   []time.Time{time.Unix(1700000000, 250e6)},
+		},
+		{
+			name: "declared seconds", typeName: "integer", timeColumnType: "s",
+			epochs: []driver.Value{int64(-60), int64(0)},
+			want:   []time.Time{time.Unix(-60, 0), time.Unix(0, 0)},
+		},
+		{
+			name: "declared milliseconds", typeName: "integer", timeColumnType: "ms",
+			epochs: []driver.Value{int64(3600000)},
+			want:   []time.Time{time.Unix(3600, 0)},
+		},
+	}
+	for _, tt := range tests {
+		result := fakeResult{columns: []fakeColumn{{name: "time", typeName: tt.typeName}, {name: "value", typeName: "float"}}}
+		for _, epoch := range tt.epochs {
+			result.rows = append(result.rows, []driver.Value{epoch, 1.0})
+		}
+		frames := buildFakeTimeSeries(t, result, queryModel{TimeColumnType: tt.timeColumnType}, timeRange)
+		times := frameTimes(t, frames[0])
+		if len(times) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, times, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if !times[i].Equal(tt.want[i]) {
+				t.Errorf("%s: point %d at %v, want %v", tt.name, i, times[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestEpochTimeColumnsTableAndAnnotations(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := fakeResult{
+		columns: []fakeColumn{{name: "time", typeName: "integer"}, {name: "text", typeName: "varchar"}},
+		rows:    [][]driver.Value{{int64(3600000), "deploy"}},
+	}
+	v := &VerticaDatasource{}
+
+	// an undeclared INTEGER time column of a table holds milliseconds
+	frame, err := v.buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := frame.Fields[0].At(0).(*time.Time); !ok || !got.Equal(time.Unix(3600, 0)) {
+		t.Errorf("table: got %v, want %v", frame.Fields[0].At(0), time.Unix(3600, 0))
+	}
+	frame, err = v.buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{TimeColumnType: "s"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := frame.Fields[0].At(0).(*time.Time); !ok || !got.Equal(time.Unix(3600000, 0)) {
+		t.Errorf("table in seconds: got %v, want %v", frame.Fields[0].At(0), time.Unix(3600000, 0))
+	}
+
+	frame, err = v.buildAnnotationsResult(queryFake(t, &fakeConnector{result: result}), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := frame.Fields[0].At(0).(time.Time); !got.Equal(time.Unix(3600, 0)) {
+		t.Errorf("annotations: got %v, want %v", got, time.Unix(3600, 0))
+	}
+}
+
+func TestTimeSeriesDetectTimeColumn(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeRange := backend.TimeRange{From: start, To: start.Add(time.Hour)}
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first timestamp column is used wherever it is in the select list
+	result := fakeResult{
+		columns: []fakeColumn{
+			{name: "load", typeName: "float"},
+			{name: "sampled_at", typeName: "timestamp"},
+			{name: "loaded_at", typeName: "timestamp"},
+			{name: "rows", typeName: "integer"},
+		},
+		rows: [][]driver.Value{{1.5, start, start.Add(time.Hour), int64(10)}},
+	}
+	frames := buildFakeTimeSeries(t, result, queryModel{}, timeRange)
+	if got := frames[0].Meta.Custom["timeColumn"]; got != "sampled_at" {
+		t.Errorf("timeColumn: got %v, want sampled_at", got)
+	}
+	if times := frameTimes(t, frames[0]); len(times) != 1 || !times[0].Equal(start) {
+		t.Errorf("got times %v, want [%v]", times, start)
+	}
+	if len(frames) != 2 || frames[0].Fields[1].Name != "load" || frames[1].Fields[1].Name != "rows" {
+		t.Errorf("got series %v", frames)
+	}
+
+	// a column aliased time is preferred
+	result.columns[2].name = "time"
+	frames = buildFakeTimeSeries(t, result, queryModel{}, timeRange)
+	if got := frames[0].Meta.Custom["timeColumn"]; got != "time" {
+		t.Errorf("timeColumn: got %v, want time", got)
+	}
+
+	// without a time column the error lists the columns and their types
+	result = fakeResult{
+		columns: []fakeColumn{{name: "host", typeName: "varchar"}, {name: "load", typeName: "float"}},
+		rows:    [][]driver.Value{{"a", 1.5}},
+	}
+	query := backend.DataQuery{TimeRange: timeRange, Interval: time.Minute, MaxDataPoints: 1000}
+	_, err = (&VerticaDatasource{}).buildSeriesTimeSeriesResult(queryFake(t, &fakeConnector{result: result}), queryModel{Format: formatTimeSeries}, query, config)
+	if err == nil || !strings.Contains(err.Error(), "host (*string)") || !strings.Contains(err.Error(), "load (*float64)") {
+		t.Errorf("got error %v, want one listing the columns", err)
+	}
+}
+
+func TestFormatAlias(t *testing.T) {
+	vars := map[string]string{"metric": "cpu", "node_name": "v_node0001", "column": "value", "empty": ""}
+	tests := []struct {
+		alias string
+		want  string
+	}{
+		{alias: "{{metric}} on {{node_name}}", want: "cpu on v_node0001"},
+		{alias: "{{ column }}", want: "value"},
+		{alias: "[{{empty}}]", want: "[]"},
+		{alias: "{{unknown}} {{metric}}", want: "{{unknown}} cpu"},
+		{alias: "{metric} {{metric", want: "{metric} {{metric"},
+	}
+	for _, tt := range tests {
+		if got := formatAlias(tt.alias, vars); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.alias, got, tt.want)
+		}
+	}
+}
+
+func TestTimeSeriesAlias(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeRange := backend.TimeRange{From: start, To: start.Add(time.Hour)}
+	displayNames := func(frames []*data.Frame) []string {
+		var names []string
+		for _, frame := range frames {
+			if frame.Fields[1].Config == nil {
+				names = append(names, "")
+				continue
+			}
+			names = append(names, frame.Fields[1].Config.DisplayName)
+		}
+		return names
+	}
+
+	// a metric and several label columns
+	result := fakeResult{
+		columns: []fakeColumn{
+			{name: "time", typeName: "timestamp"},
+			{name: "metric", typeName: "varchar"},
+			{name: "node_name", typeName: "varchar"},
+			{name: "dc", typeName: "varchar"},
+			{name: "value", typeName: "float"},
+		},
+		rows: [][]driver.Value{
+			{start, "cpu", "v_node0001", "east", 1.0},
+			{start, "cpu", "v_node0002", "west", 2.0},
+			{start, "mem", "v_node0001", "east", 3.0},
+		},
+	}
+	frames := buildFakeTimeSeries(t, result, queryModel{Alias: "{{metric}} {{node_name}}/{{dc}} {{column}} {{rack}}"}, timeRange)
+	want := []string{
+		"cpu v_node0001/east value {{rack}}",
+		"cpu v_node0002/west value {{rack}}",
+		"mem v_node0001/east value {{rack}}",
+	}
+	if got := displayNames(frames); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// without a metric column its placeholder is kept
+	result = fakeResult{
+		columns: []fakeColumn{
+			{name: "time", typeName: "timestamp"},
+			{name: "node_name", typeName: "varchar"},
+			{name: "cpu_pct", typeName: "float"},
+			{name: "mem_pct", typeName: "float"},
+		},
+		rows: [][]driver.Value{{start, "v_node0001", 1.0, 2.0}},
+	}
+	frames = buildFakeTimeSeries(t, result, queryModel{Alias: "{{node_name}} {{column}} {{metric}}"}, timeRange)
+	want = []string{"v_node0001 cpu_pct {{metric}}", "v_node0001 mem_pct {{metric}}"}
+	if got := displayNames(frames); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTimeSeriesBooleanColumns(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	result := fakeResult{
+		columns: []fakeColumn{
+			{name: "time", typeName: "timestamp"},
+			{name: "is_primary", typeName: "boolean"},
+			{name: "load", typeName: "float"},
+		},
+		rows: [][]driver.Value{
+			{start, true, 0.5},
+			{start.Add(time.Minute), false, 1.5},
+			{start.Add(2 * time.Minute), nil, 2.5},
+		},
+	}
+	frames := buildFakeTimeSeries(t, result, queryModel{}, backend.TimeRange{From: start, To: start.Add(2 * time.Minute)})
+	if len(frames) != 2 {
+		t.Fatalf("got %d series, want 2", len(frames))
+	}
+	if got := frameValues(t, frames[0]); !sameValues(got, []float64{1, 0, math.NaN()}) {
+		t.Errorf("is_primary: got %v, want [1 0 NULL]", got)
+	}
+	if got := frameValues(t, frames[1]); !sameValues(got, []float64{0.5, 1.5, 2.5}) {
+		t.Errorf("load: got %v, want [0.5 1.5 2.5]", got)
+	}
+	booleans, ok := frames[0].Meta.Custom["booleanColumns"].(map[string]interface{})
+	if !ok || !reflect.DeepEqual(booleans["columns"], []string{"is_primary"}) {
+		t.Errorf("booleanColumns: got %v", frames[0].Meta.Custom["booleanColumns"])
+	}
+
+	// tables keep the booleans
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := (&VerticaDatasource{}).buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := frame.Fields[1].Type(); got != data.FieldTypeNullableBool {
+		t.Errorf("table column type %v, want %v", got, data.FieldTypeNullableBool)
+	}
+}
+
+func TestTimeSeriesTimePrecision(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// two events 500µs apart, within the same millisecond
+	first, second := start.Add(100*time.Microsecond), start.Add(600*time.Microsecond)
+	result := fakeResult{
+		columns: []fakeColumn{{name: "time", typeName: "timestamp"}, {name: "value", typeName: "float"}},
+		rows:    [][]driver.Value{{first, 1.0}, {second, 2.0}},
+	}
+	tests := []struct {
+		precision string
+		want      []time.Time
+	}{
+		{precision: "", want: []time.Time{start, start}},
+		{precision: "us", want: []time.Time{first, second}},
+		{precision: "ns", want: []time.Time{first, second}},
+	}
+	for _, tt := range tests {
+		frames := buildFakeTimeSeries(t, result, queryModel{TimePrecision: tt.precision}, backend.TimeRange{From: start, To: start.Add(time.Second)})
+		times := frameTimes(t, frames[0])
+		if len(times) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.precision, times, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if !times[i].Equal(tt.want[i]) {
+				t.Errorf("%q: point %d at %v, want %v", tt.precision, i, times[i], tt.want[i])
+			}
+		}
+		// both events are kept in order even when their emitted times are equal
+		if got := frameValues(t, frames[0]); !sameValues(got, []float64{1, 2}) {
+			t.Errorf("%q: got values %v, want [1 2]", tt.precision, got)
+		}
+	}
+}
+
+func TestPivotWide(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+	// the same instants, read in another location
+	firstBerlin, secondBerlin := first.In(berlin), second.In(berlin)
+	str := func(s string) *string { return &s }
+	num := func(f float64) *float64 { return &f }
+	frame := data.NewFrame("results",
+		data.NewField("time", nil, []*time.Time{&second, &first, &firstBerlin, &secondBerlin}),
+		data.NewField("metric", nil, []*string{str("cpu"), str("cpu"), str("mem"), nil}),
+		data.NewField("value", nil, []*float64{num(2), num(1), num(3), num(4)}),
+	)
+	wide, err := pivotWide(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wide.Rows() != 2 {
+		t.Fatalf("got %d rows, want 2", wide.Rows())
+	}
+	if got := wide.Fields[0].At(0).(time.Time); !got.Equal(first) {
+		t.Errorf("first row at %v, want %v", got, first)
+	}
+	want := map[string][]float64{"cpu": {1, 2}, "mem": {3, math.NaN()}, "null": {math.NaN(), 4}}
+	if len(wide.Fields) != 1+len(want) {
+		t.Fatalf("got %d fields, want %d", len(wide.Fields), 1+len(want))
+	}
+	for _, field := range wide.Fields[1:] {
+		values := make([]*float64, field.Len())
+		for i := range values {
+			values[i] = field.At(i).(*float64)
+		}
+		if !sameValues(values, want[field.Name]) {
+			t.Errorf("%s: got %v, want %v", field.Name, values, want[field.Name])
+		}
+	}
+}
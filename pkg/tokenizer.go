@@ -0,0 +1,126 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"regexp"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenCode tokenKind = iota
+	tokenString
+	tokenIdentifier
+	tokenComment
+)
+
+var dollarTagPattern = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// scanToken returns the end of the string literal, quoted identifier or
+// comment starting at offset i of sql and its kind. For plain code it returns
+// i+1 and tokenCode. Unterminated tokens end at the end of sql.
+func scanToken(sql string, i int) (int, tokenKind) {
+	rest := sql[i:]
+	switch {
+	case strings.HasPrefix(rest, "--"):
+		if end := strings.IndexByte(rest, '\n'); end != -1 {
+			return i + end + 1, tokenComment
+		}
+		return len(sql), tokenComment
+	case strings.HasPrefix(rest, "/*"):
+		return scanBlockComment(sql, i), tokenComment
+	case rest[0] == '\'':
+		return scanQuoted(sql, i+1, '\'', false), tokenString
+	case (rest[0] == 'E' || rest[0] == 'e') && len(rest) > 1 && rest[1] == '\'' && (i == 0 || !isIdentChar(sql[i-1])):
+		return scanQuoted(sql, i+2, '\'', true), tokenString
+	case rest[0] == '"':
+		return scanQuoted(sql, i+1, '"', false), tokenIdentifier
+	case rest[0] == '$':
+		if tag := dollarTagPattern.FindString(rest); tag != "" {
+			if end := strings.Index(rest[len(tag):], tag); end != -1 {
+				return i + len(tag) + end + len(tag), tokenString
+			}
+			return len(sql), tokenString
+		}
+	}
+	return i + 1, tokenCode
+}
+
+// scanBlockComment returns the end of the possibly nested block comment
+// starting at offset i of sql.
+func scanBlockComment(sql string, i int) int {
+	depth := 0
+	for i < len(sql) {
+		switch {
+		case strings.HasPrefix(sql[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(sql[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(sql)
+}
+
+// scanQuoted returns the end of a quoted token whose content starts at offset
+// i of sql. A doubled quote stands for the quote itself and, with backslash
+// set, so does a quote escaped by a backslash.
+func scanQuoted(sql string, i int, quote byte, backslash bool) int {
+	for i < len(sql) {
+		switch {
+		case backslash && sql[i] == '\\':
+			i += 2
+		case sql[i] == quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(sql)
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestScanToken(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+		kind tokenKind
+	}{
+		{name: "code", sql: "SELECT", want: "S", kind: tokenCode},
+		{name: "line comment", sql: "-- a 'b\nSELECT", want: "-- a 'b\n", kind: tokenComment},
+		{name: "line comment at the end", sql: "-- a", want: "-- a", kind: tokenComment},
+		{name: "block comment", sql: "/* a */ SELECT", want: "/* a */", kind: tokenComment},
+		{name: "nested block comment", sql: "/* a /* b */ c */ SELECT", want: "/* a /* b */ c */", kind: tokenComment},
+		{name: "deeply nested block comment", sql: "/*/**/*/*/", want: "/*/**/*/", kind: tokenComment},
+		{name: "unterminated nested block comment", sql: "/* a /* b */ c", want: "/* a /* b */ c", kind: tokenComment},
+		{name: "quote in a block comment", sql: "/* it's */ x", want: "/* it's */", kind: tokenComment},
+		{name: "string", sql: "'a' || x", want: "'a'", kind: tokenString},
+		{name: "doubled quote", sql: "'it''s' x", want: "'it''s'", kind: tokenString},
+		{name: "only doubled quotes", sql: "'''''' x", want: "''''''", kind: tokenString},
+		{name: "empty string", sql: "'' x", want: "''", kind: tokenString},
+		{name: "backslash in a standard string", sql: `'a\' x`, want: `'a\'`, kind: tokenString},
+		{name: "unterminated string", sql: "'abc", want: "'abc", kind: tokenString},
+		{name: "escaped quote in an E string", sql: `E'\'' x`, want: `E'\''`, kind: tokenString},
+		{name: "escaped backslash in an E string", sql: `E'\\' x`, want: `E'\\'`, kind: tokenString},
+		{name: "doubled quote in an E string", sql: `e'a''b' x`, want: `e'a''b'`, kind: tokenString},
+		{name: "trailing backslash in an E string", sql: `E'\`, want: `E'\`, kind: tokenString},
+		{name: "dollar quote", sql: "$$ it's $$ x", want: "$$ it's $$", kind: tokenString},
+		{name: "tagged dollar quote", sql: "$fn$ $$ ' $fn$ x", want: "$fn$ $$ ' $fn$", kind: tokenString},
+		{name: "unterminated dollar quote", sql: "$fn$ abc", want: "$fn$ abc", kind: tokenString},
+		{name: "dollar sign", sql: "$1", want: "$", kind: tokenCode},
+		{name: "macro", sql: "$__timeFrom()", want: "$", kind: tokenCode},
+		{name: "quoted identifier", sql: `"a b" x`, want: `"a b"`, kind: tokenIdentifier},
+		{name: "doubled quote in a quoted identifier", sql: `"a""b" x`, want: `"a""b"`, kind: tokenIdentifier},
+		{name: "single quote in a quoted identifier", sql: `"it's" x`, want: `"it's"`, kind: tokenIdentifier},
+		{name: "backslash in a quoted identifier", sql: `"a\" x`, want: `"a\"`, kind: tokenIdentifier},
+	}
+	for _, tt := range tests {
+		end, kind := scanToken(tt.sql, 0)
+		if got := tt.sql[:end]; got != tt.want || kind != tt.kind {
+			t.Errorf("%s: got %q (%d), want %q (%d)", tt.name, got, kind, tt.want, tt.kind)
+		}
+	}
+}
+
+func TestScanTokenEString(t *testing.T) {
+	// an E ending an identifier does not start an E string
+	sql := `namE'\'`
+	if end, kind := scanToken(sql, 3); end != 4 || kind != tokenCode {
+		t.Errorf("identifier: got %d (%d), want 4 (%d)", end, kind, tokenCode)
+	}
+	if end, kind := scanToken(sql, 4); sql[4:end] != `'\'` || kind != tokenString {
+		t.Errorf("string: got %q (%d), want %q (%d)", sql[4:end], kind, `'\'`, tokenString)
+	}
+
+	sql = `x=E'\''`
+	if end, kind := scanToken(sql, 2); sql[2:end] != `E'\''` || kind != tokenString {
+		t.Errorf("after an operator: got %q (%d), want %q (%d)", sql[2:end], kind, `E'\''`, tokenString)
+	}
+}
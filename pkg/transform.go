@@ -0,0 +1,107 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	transformNone       = ""
+	transformRate       = "rate"
+	transformDerivative = "derivative"
+)
+
+// parseTransform normalizes the series transform of a query.
+func parseTransform(transform string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(transform)) {
+	case "", "none":
+		return transformNone, nil
+	case transformRate:
+		return transformRate, nil
+	case transformDerivative:
+		return transformDerivative, nil
+	default:
+		return "", fmt.Errorf("unsupported transform: %s", transform)
+	}
+}
+
+// transform replaces the values of s by their change per second. The first
+// point has no predecessor and is dropped. For rate, counter resets are
+// clamped to zero. NULL values stay NULL and are skipped as predecessors.
+// Points are expected to be ordered by time.
+func (s *timeSeries) transform(transform string) {
+	if transform == transformNone || len(s.times) == 0 {
+		return
+	}
+
+	times := make([]time.Time, 0, len(s.times)-1)
+	values := make([]*float64, 0, len(s.values)-1)
+
+	prev := -1
+	for i := range s.times {
+		if prev == -1 {
+			if s.values[i] != nil {
+				prev = i
+			} else if i > 0 {
+				times = append(times, s.times[i])
+				values = append(values, nil)
+			}
+			continue
+		}
+
+		times = append(times, s.times[i])
+		if s.values[i] == nil {
+			values = append(values, nil)
+			continue
+		}
+
+		seconds := s.times[i].Sub(s.times[prev]).Seconds()
+		if seconds <= 0 {
+			values = append(values, nil)
+			continue
+		}
+		delta := *s.values[i] - *s.values[prev]
+		if transform == transformRate && delta < 0 {
+			delta = 0
+		}
+		v := delta / seconds
+		values = append(values, &v)
+		prev = i
+	}
+
+	s.times = times
+	s.values = values
+}
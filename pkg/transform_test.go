@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestParseTransform(t *testing.T) {
+	tests := []struct {
+		transform string
+		want      string
+		wantErr   bool
+	}{
+		{transform: "", want: transformNone},
+		{transform: "none", want: transformNone},
+		{transform: " Rate ", want: transformRate},
+		{transform: "derivative", want: transformDerivative},
+		{transform: "integral", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTransform(tt.transform)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.transform)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.transform, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.transform, got, tt.want)
+		}
+	}
+}
+
+func TestTimeSeriesTransform(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	value := func(v float64) *float64 { return &v }
+	type point struct {
+		seconds int
+		value   *float64
+	}
+	tests := []struct {
+		name      string
+		transform string
+		points    []point
+		want      []point
+	}{
+		{
+			name:      "none",
+			transform: transformNone,
+			points:    []point{{0, value(1)}, {10, value(2)}},
+			want:      []point{{0, value(1)}, {10, value(2)}},
+		},
+		{
+			name:      "rate over irregular intervals",
+			transform: transformRate,
+			points:    []point{{0, value(10)}, {10, value(20)}, {30, value(60)}, {35, value(65)}},
+			want:      []point{{10, value(1)}, {30, value(2)}, {35, value(1)}},
+		},
+		{
+			name:      "rate across a counter reset",
+			transform: transformRate,
+			points:    []point{{0, value(100)}, {10, value(150)}, {20, value(5)}, {30, value(25)}},
+			want:      []point{{10, value(5)}, {20, value(0)}, {30, value(2)}},
+		},
+		{
+			name:      "derivative keeps decreases",
+			transform: transformDerivative,
+			points:    []point{{0, value(100)}, {10, value(150)}, {30, value(50)}},
+			want:      []point{{10, value(5)}, {30, value(-5)}},
+		},
+		{
+			name:      "NULL values are skipped as predecessors",
+			transform: transformRate,
+			points:    []point{{0, value(10)}, {10, nil}, {40, value(50)}},
+			want:      []point{{10, nil}, {40, value(1)}},
+		},
+		{
+			name:      "leading NULL",
+			transform: transformRate,
+			points:    []point{{0, nil}, {10, value(10)}, {20, value(30)}},
+			want:      []point{{20, value(2)}},
+		},
+		{
+			name:      "repeated time",
+			transform: transformRate,
+			points:    []point{{0, value(10)}, {0, value(20)}, {10, value(30)}},
+			want:      []point{{0, nil}, {10, value(2)}},
+		},
+		{
+			name:      "single point",
+			transform: transformRate,
+			points:    []point{{0, value(10)}},
+			want:      []point{},
+		},
+	}
+	for _, tt := range tests {
+		s := &timeSeries{name: tt.name}
+		for _, p := range tt.points {
+			s.append(at(p.seconds), p.value)
+		}
+		s.transform(tt.transform)
+		if len(s.times) != len(tt.want) {
+			t.Errorf("%s: got %d points %v, want %d", tt.name, len(s.times), s.times, len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			if !s.times[i].Equal(at(want.seconds)) {
+				t.Errorf("%s: point %d at %v, want %v", tt.name, i, s.times[i], at(want.seconds))
+			}
+			if (s.values[i] == nil) != (want.value == nil) || s.values[i] != nil && *s.values[i] != *want.value {
+				t.Errorf("%s: point %d value %v, want %v", tt.name, i, s.values[i], want.value)
+			}
+		}
+	}
+}
+
+func TestBuildSeriesTimeSeriesResultTransform(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	result := fakeResult{
+		columns: []fakeColumn{
+			{name: "time", typeName: "timestamp"},
+			{name: "metric", typeName: "varchar"},
+			{name: "bytes_sent", typeName: "integer"},
+		},
+		rows: [][]driver.Value{
+			{at(0), "a", int64(0)},
+			{at(0), "b", int64(1000)},
+			{at(10), "a", int64(100)},
+			{at(15), "b", int64(10)},
+			{at(30), "a", int64(400)},
+			{at(45), "b", int64(310)},
+		},
+	}
+	frames := buildFakeTimeSeries(t, result, queryModel{Transform: "rate"}, backend.TimeRange{From: at(0), To: at(60)})
+	want := map[string][]float64{"a": {10, 15}, "b": {0, 10}}
+	wantTimes := map[string][]time.Time{"a": {at(10), at(30)}, "b": {at(15), at(45)}}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	for _, frame := range frames {
+		name := frame.Fields[1].Name
+		times := frameTimes(t, frame)
+		if len(times) != len(wantTimes[name]) {
+			t.Errorf("%s: got %v, want %v", name, times, wantTimes[name])
+			continue
+		}
+		for i := range times {
+			if !times[i].Equal(wantTimes[name][i]) {
+				t.Errorf("%s: point %d at %v, want %v", name, i, times[i], wantTimes[name][i])
+			}
+			if got, ok := frame.Fields[1].At(i).(*float64); !ok || got == nil || *got != want[name][i] {
+				t.Errorf("%s: point %d value %v, want %v", name, i, frame.Fields[1].At(i), want[name][i])
+			}
+		}
+	}
+}
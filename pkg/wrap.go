@@ -0,0 +1,188 @@
+package main
+
+// Copyright (c) 2019 Micro Focus or one of its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// isGeoType reports whether a column holds spatial data. The driver reports
+// GEOMETRY and GEOGRAPHY columns by their type name.
+func isGeoType(databaseTypeName string) bool {
+	switch databaseTypeName {
+	case "geometry", "geography":
+		return true
+	default:
+		return false
+	}
+}
+
+// vmapColumn is the name of the column holding the VMap of a flex table.
+const vmapColumn = "__raw__"
+
+// vmapErrorMarker replaces the values of a VMap column MAPTOSTRING failed on.
+const vmapErrorMarker = "[invalid VMap]"
+
+// isVMapColumn reports whether a column holds a flex table VMap, which is
+// binary data only Vertica can decode.
+func isVMapColumn(colType *sql.ColumnType) bool {
+	return strings.EqualFold(colType.Name(), vmapColumn) && isBinaryType(colType.DatabaseTypeName())
+}
+
+// mayReturnVMap reports whether rawSql may return the VMap column of a flex
+// table: it names the column outside of strings and comments, or selects
+// every column with *. A * multiplying is a false positive, which only costs
+// a probe.
+func mayReturnVMap(rawSql string) bool {
+	for i := 0; i < len(rawSql); {
+		next, kind := scanToken(rawSql, i)
+		switch kind {
+		case tokenCode:
+			if rawSql[i] == '*' {
+				return true
+			}
+			end := i + len(vmapColumn)
+			if end <= len(rawSql) && strings.EqualFold(rawSql[i:end], vmapColumn) &&
+				(i == 0 || !isIdentChar(rawSql[i-1])) && (end == len(rawSql) || !isIdentChar(rawSql[end])) {
+				return true
+			}
+		case tokenIdentifier:
+			if strings.EqualFold(rawSql[i:next], `"`+vmapColumn+`"`) {
+				return true
+			}
+		}
+		i = next
+	}
+	return false
+}
+
+// wrapColumns returns rawSql wrapped in a query that converts the columns the
+// plugin cannot render itself: flex table VMaps become JSON with MAPTOSTRING,
+// with geoAsText set, spatial columns become WKT with ST_AsText and, with
+// numericAsString set, NUMERIC columns are cast to VARCHAR so none of their
+// digits go through float64. It returns false when no column of colTypes needs
+// converting.
+func wrapColumns(rawSql string, colTypes []*sql.ColumnType, geoAsText bool, numericAsString bool) (string, bool) {
+	wrapped := false
+	columns := make([]string, len(colTypes))
+	for i, colType := range colTypes {
+		name := `"` + strings.ReplaceAll(colType.Name(), `"`, `""`) + `"`
+		switch {
+		case isVMapColumn(colType):
+			columns[i] = fmt.Sprintf("MAPTOSTRING(%s) AS %s", name, name)
+			wrapped = true
+		case geoAsText && isGeoType(colType.DatabaseTypeName()):
+			columns[i] = fmt.Sprintf("ST_AsText(%s) AS %s", name, name)
+			wrapped = true
+		case numericAsString && colType.DatabaseTypeName() == "numeric":
+			columns[i] = fmt.Sprintf("%s::VARCHAR AS %s", name, name)
+			wrapped = true
+		default:
+			columns[i] = name
+		}
+	}
+	if !wrapped {
+		return "", false
+	}
+	return fmt.Sprintf("SELECT %s FROM (%s) AS wrapped_source", strings.Join(columns, ", "), trimStatement(rawSql)), true
+}
+
+// trimStatement returns rawSql without the whitespace, comments and semicolons
+// ending it, so it can be wrapped in a subquery. A trailing line comment would
+// otherwise swallow the rest of the wrapping query.
+func trimStatement(rawSql string) string {
+	end := 0
+	for i := 0; i < len(rawSql); {
+		next, kind := scanToken(rawSql, i)
+		switch {
+		case kind == tokenComment:
+		case kind == tokenCode && (rawSql[i] == ';' || unicode.IsSpace(rune(rawSql[i]))):
+		default:
+			end = next
+		}
+		i = next
+	}
+	return rawSql[:end]
+}
+
+// queryer runs queries, such as the *sql.Conn holding the session of a query.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryColumns runs rawSql on conn, wrapped by wrapColumns when one of its
+// columns needs converting, and returns the rows along with the SQL that was
+// run. The column types are probed with a LIMIT 0 query around rawSql, so the
+// statement itself runs once, and only when a column may need converting.
+// Statements that cannot be wrapped, such as SHOW or several statements, run
+// as they are.
+func queryColumns(ctx context.Context, conn queryer, rawSql string, geoAsText bool, numericAsString bool) (*sql.Rows, string, error) {
+	if !geoAsText && !numericAsString && !mayReturnVMap(rawSql) {
+		rows, err := conn.QueryContext(ctx, rawSql)
+		return rows, rawSql, err
+	}
+	probe, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT * FROM (%s) AS probe LIMIT 0", trimStatement(rawSql)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, rawSql, err
+		}
+		log.DefaultLogger.Debug("Probing columns failed, running the query unconverted", "error", err)
+		rows, err := conn.QueryContext(ctx, rawSql)
+		return rows, rawSql, err
+	}
+	colTypes, err := probe.ColumnTypes()
+	probe.Close()
+	if err != nil {
+		return nil, rawSql, err
+	}
+
+	wrappedSQL, ok := wrapColumns(rawSql, colTypes, geoAsText, numericAsString)
+	if !ok {
+		rows, err := conn.QueryContext(ctx, rawSql)
+		return rows, rawSql, err
+	}
+	rows, err := conn.QueryContext(ctx, wrappedSQL)
+	if err == nil || ctx.Err() != nil {
+		return rows, wrappedSQL, err
+	}
+	// rerun the original query, its undecodable columns get a marker
+	log.DefaultLogger.Warn("Converting columns failed", "error", err)
+	rows, err = conn.QueryContext(ctx, rawSql)
+	return rows, rawSql, err
+}
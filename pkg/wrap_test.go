@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestWrapColumnsNumericAsString(t *testing.T) {
+	colTypes := fakeColumnTypes(t, fakeResult{columns: []fakeColumn{
+		{name: "id", typeName: "integer"},
+		{name: "amount", typeName: "numeric", precision: 38, scale: 10},
+	}})
+
+	if wrapped, ok := wrapColumns("SELECT id, amount FROM ledger", colTypes, false, false); ok {
+		t.Fatalf("wrapped without numericAsString: %s", wrapped)
+	}
+	wrapped, ok := wrapColumns("SELECT id, amount FROM ledger;", colTypes, false, true)
+	if !ok {
+		t.Fatal("NUMERIC column not wrapped")
+	}
+	want := `SELECT "id", "amount"::VARCHAR AS "amount" FROM (SELECT id, amount FROM ledger) AS wrapped_source`
+	if wrapped != want {
+		t.Errorf("got %s, want %s", wrapped, want)
+	}
+}
+
+func TestBuildTableQueryResultNumericAsString(t *testing.T) {
+	config, err := loadConfigArgs(&backend.DataSourceInstanceSettings{JSONData: []byte(`{"numericAsString":true}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &VerticaDatasource{}
+
+	// wrapColumns cast the NUMERIC(38,10) column, every digit arrives
+	exact := []string{"12345678901234567890.1234567890", "-12345678901234567890.1234567890", "-0.0000000001"}
+	result := fakeResult{columns: []fakeColumn{{name: "amount", typeName: "varchar"}}}
+	for _, value := range exact {
+		result.rows = append(result.rows, []driver.Value{value})
+	}
+	frame, err := v.buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row, want := range exact {
+		if got, ok := frame.Fields[0].At(row).(*string); !ok || got == nil || *got != want {
+			t.Errorf("row %d: got %v, want %s", row, frame.Fields[0].At(row), want)
+		}
+	}
+	if _, ok := frame.Meta.Custom["impreciseNumerics"]; ok {
+		t.Error("cast values flagged as imprecise")
+	}
+
+	// the wrapped query failed, the driver's float64 values are flagged
+	result = fakeResult{
+		columns: []fakeColumn{{name: "amount", typeName: "numeric", precision: 38, scale: 10}},
+		rows: [][]driver.Value{
+			{12345678901234567890.1234567890},
+			{-1234.5},
+		},
+	}
+	frame, err = v.buildTableQueryResult(queryFake(t, &fakeConnector{result: result}), queryModel{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := frame.Meta.Custom["impreciseNumerics"]; got != 1 {
+		t.Errorf("impreciseNumerics: got %v, want 1", got)
+	}
+	if got, ok := frame.Fields[0].At(1).(*string); !ok || *got != "-1234.5" {
+		t.Errorf("negative value: got %v, want -1234.5", frame.Fields[0].At(1))
+	}
+	if len(frame.Meta.Notices) == 0 || !strings.Contains(frame.Meta.Notices[0].Text, "VARCHAR") {
+		t.Errorf("missing precision notice: %v", frame.Meta.Notices)
+	}
+}
+
+func TestTrimStatement(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{sql: "SELECT 1", want: "SELECT 1"},
+		{sql: " SELECT 1 ;\n", want: " SELECT 1"},
+		{sql: "SELECT 1;;", want: "SELECT 1"},
+		{sql: "SELECT 1 -- trailing", want: "SELECT 1"},
+		{sql: "SELECT 1; -- trailing\n/* block */", want: "SELECT 1"},
+		{sql: "SELECT 1 -- inner\nFROM t -- trailing", want: "SELECT 1 -- inner\nFROM t"},
+		{sql: "SELECT '-- kept;'", want: "SELECT '-- kept;'"},
+		{sql: `SELECT 1 AS "x;" /* a /* nested */ comment */`, want: `SELECT 1 AS "x;"`},
+		{sql: "-- only a comment", want: ""},
+	}
+	for _, tt := range tests {
+		if got := trimStatement(tt.sql); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestMayReturnVMap(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{sql: "SELECT a, b FROM t", want: false},
+		{sql: "SELECT * FROM flex", want: true},
+		{sql: "SELECT t.* FROM flex t", want: true},
+		{sql: "SELECT COUNT(*) FROM t", want: true},
+		{sql: "SELECT __raw__ FROM flex", want: true},
+		{sql: "SELECT __RAW__", want: true},
+		{sql: `SELECT "__raw__" FROM flex`, want: true},
+		{sql: "SELECT __raw__x, x__raw__ FROM t", want: false},
+		{sql: "SELECT '__raw__ * ' FROM t -- __raw__ *", want: false},
+		{sql: "SELECT a /* * */ FROM t", want: false},
+	}
+	for _, tt := range tests {
+		if got := mayReturnVMap(tt.sql); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestQueryColumns(t *testing.T) {
+	numeric := fakeResult{columns: []fakeColumn{{name: "amount", typeName: "numeric"}}}
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name            string
+		sql             string
+		numericAsString bool
+		fail            string
+		want            string
+		queries         []string
+	}{
+		{
+			name:    "nothing to convert is not probed",
+			sql:     "SELECT amount FROM t -- note",
+			want:    "SELECT amount FROM t -- note",
+			queries: []string{"SELECT amount FROM t -- note"},
+		},
+		{
+			name: "every column may hold a VMap",
+			sql:  "SELECT * FROM t",
+			want: "SELECT * FROM t",
+			queries: []string{
+				"SELECT * FROM (SELECT * FROM t) AS probe LIMIT 0",
+				"SELECT * FROM t",
+			},
+		},
+		{
+			name:            "converted",
+			sql:             "SELECT amount FROM t; -- note",
+			numericAsString: true,
+			want:            `SELECT "amount"::VARCHAR AS "amount" FROM (SELECT amount FROM t) AS wrapped_source`,
+			queries: []string{
+				"SELECT * FROM (SELECT amount FROM t) AS probe LIMIT 0",
+				`SELECT "amount"::VARCHAR AS "amount" FROM (SELECT amount FROM t) AS wrapped_source`,
+			},
+		},
+		{
+			name:            "statement that cannot be wrapped",
+			sql:             "SHOW search_path",
+			numericAsString: true,
+			fail:            "SELECT * FROM (SHOW",
+			want:            "SHOW search_path",
+			queries: []string{
+				"SELECT * FROM (SHOW search_path) AS probe LIMIT 0",
+				"SHOW search_path",
+			},
+		},
+		{
+			name:            "conversion failed",
+			sql:             "SELECT amount FROM t",
+			numericAsString: true,
+			fail:            `SELECT "amount"`,
+			want:            "SELECT amount FROM t",
+			queries: []string{
+				"SELECT * FROM (SELECT amount FROM t) AS probe LIMIT 0",
+				`SELECT "amount"::VARCHAR AS "amount" FROM (SELECT amount FROM t) AS wrapped_source`,
+				"SELECT amount FROM t",
+			},
+		},
+	}
+	for _, tt := range tests {
+		connector := &fakeConnector{result: numeric}
+		if tt.fail != "" {
+			connector.fail = func(query string) error {
+				if strings.HasPrefix(query, tt.fail) {
+					return errFailed
+				}
+				return nil
+			}
+		}
+		db := sql.OpenDB(connector)
+		rows, got, err := queryColumns(context.Background(), db, tt.sql, false, tt.numericAsString)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			db.Close()
+			continue
+		}
+		rows.Close()
+		db.Close()
+		if got != tt.want {
+			t.Errorf("%s: ran %s, want %s", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(connector.queries, tt.queries) {
+			t.Errorf("%s: queries %q, want %q", tt.name, connector.queries, tt.queries)
+		}
+	}
+}
@@ -2,19 +2,43 @@ import React, { PureComponent } from 'react';
 import { LegacyForms } from '@grafana/ui';
 import {
   DataSourcePluginOptionsEditorProps,
+  onUpdateDatasourceJsonDataOption,
+  onUpdateDatasourceJsonDataOptionChecked,
+  onUpdateDatasourceJsonDataOptionSelect,
   onUpdateDatasourceOption,
   onUpdateDatasourceSecureJsonDataOption,
   updateDatasourcePluginResetOption,
 } from '@grafana/data';
 import { VerticaDataSourceOptions, VerticaSecureJsonData } from './types';
 
-const { SecretFormField, FormField } = LegacyForms;
+const { SecretFormField, FormField, Select, Switch } = LegacyForms;
+
+const tlsModes = [
+  { value: 'none', label: 'none' },
+  { value: 'server', label: 'server' },
+  { value: 'server-strict', label: 'server-strict' },
+];
 
 interface Props extends DataSourcePluginOptionsEditorProps<VerticaDataSourceOptions> {}
 
 interface State {}
 
+type NumberOption = 'queryTimeoutSeconds' | 'connectionTimeoutSeconds';
+
 export class ConfigEditor extends PureComponent<Props, State> {
+  // jsonData numbers are read as integers by the backend, an empty field removes the option
+  onUpdateNumberOption = (key: NumberOption) => (event: React.SyntheticEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const value = parseInt(event.currentTarget.value, 10);
+    const jsonData = { ...options.jsonData };
+    if (isNaN(value)) {
+      delete jsonData[key];
+    } else {
+      jsonData[key] = value;
+    }
+    onOptionsChange({ ...options, jsonData });
+  };
+
   render() {
     const { options } = this.props;
     const { secureJsonFields } = options;
@@ -32,6 +56,7 @@ export class ConfigEditor extends PureComponent<Props, State> {
               onChange={onUpdateDatasourceOption(this.props, 'url')}
               value={options.url || ''}
               placeholder="localhost:5433"
+              tooltip="host[:port], optionally followed by comma separated backup hosts."
               required
             />
           </div>
@@ -71,6 +96,57 @@ export class ConfigEditor extends PureComponent<Props, State> {
               />
             </div>
           </div>
+          <div className="gf-form">
+            <span className="gf-form-label width-7">TLS Mode</span>
+            <Select
+              className="width-15"
+              options={tlsModes}
+              value={tlsModes.find(mode => mode.value === (options.jsonData.tlsmode || 'none'))}
+              onChange={onUpdateDatasourceJsonDataOptionSelect(this.props, 'tlsmode')}
+            />
+          </div>
+          <Switch
+            label="TLS Skip Verify"
+            labelClass="width-7"
+            tooltip="Encrypt without verifying the server certificate. Only meant for test clusters."
+            checked={options.jsonData.tlsSkipVerify || false}
+            onChange={onUpdateDatasourceJsonDataOptionChecked(this.props, 'tlsSkipVerify')}
+          />
+          <div className="gf-form">
+            <FormField
+              label="Query Timeout"
+              labelWidth={7}
+              inputWidth={15}
+              type="number"
+              onChange={this.onUpdateNumberOption('queryTimeoutSeconds')}
+              value={options.jsonData.queryTimeoutSeconds || ''}
+              placeholder="seconds, empty for none"
+              tooltip="Each query of a panel is cancelled after this many seconds."
+            />
+          </div>
+          <div className="gf-form">
+            <FormField
+              label="Connect Timeout"
+              labelWidth={7}
+              inputWidth={15}
+              type="number"
+              onChange={this.onUpdateNumberOption('connectionTimeoutSeconds')}
+              value={options.jsonData.connectionTimeoutSeconds || ''}
+              placeholder="10"
+              tooltip="Seconds to wait for the server when connecting."
+            />
+          </div>
+          <div className="gf-form">
+            <FormField
+              label="Subcluster"
+              labelWidth={7}
+              inputWidth={15}
+              onChange={onUpdateDatasourceJsonDataOption(this.props, 'subcluster')}
+              value={options.jsonData.subcluster || ''}
+              placeholder="any"
+              tooltip="Only connect to hosts of this Eon subcluster, list its nodes in Host."
+            />
+          </div>
         </div>
         <div className="gf-form-group">
           <div className="grafana-info-box">
@@ -1,8 +1,9 @@
-import { DataSourceInstanceSettings, ScopedVars } from '@grafana/data';
+import { DataQueryRequest, DataQueryResponse, DataSourceInstanceSettings, ScopedVars } from '@grafana/data';
 import { DataSourceWithBackend, getBackendSrv, getTemplateSrv, toDataQueryResponse } from '@grafana/runtime';
 import { VerticaDataSourceOptions, VerticaQuery } from './types';
 import { MetricFindValue } from '@grafana/data/types/datasource';
 import { Table } from 'apache-arrow';
+import { Observable } from 'rxjs';
 import _ from 'lodash';
 
 export class DataSource extends DataSourceWithBackend<VerticaQuery, VerticaDataSourceOptions> {
@@ -10,6 +11,16 @@ export class DataSource extends DataSourceWithBackend<VerticaQuery, VerticaDataS
     super(instanceSettings);
   }
 
+  query(request: DataQueryRequest<VerticaQuery>): Observable<DataQueryResponse> {
+    // the backend cannot know the browser timezone
+    const timezone =
+      request.timezone === 'browser' ? Intl.DateTimeFormat().resolvedOptions().timeZone : request.timezone;
+    return super.query({
+      ...request,
+      targets: request.targets.map(target => ({ ...target, timezone })),
+    });
+  }
+
   // @ts-ignore
   applyTemplateVariables(query: VerticaQuery, scopedVars: ScopedVars): VerticaQuery {
     return {
@@ -45,6 +56,7 @@ export class DataSource extends DataSourceWithBackend<VerticaQuery, VerticaDataS
       datasourceId: this.id,
       rawSql: getTemplateSrv().replace(query, {}, this.interpolateVariable),
       format: 'table',
+      searchFilter: optionalOptions.searchFilter,
     };
 
     const range = optionalOptions.range;
@@ -1,9 +1,10 @@
 import defaults from 'lodash/defaults';
 
 import React, { PureComponent } from 'react';
-import { QueryEditorProps } from '@grafana/data';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
+import { InlineFormLabel, Select } from '@grafana/ui';
 import { DataSource } from './DataSource';
-import { defaultQuery, VerticaDataSourceOptions, VerticaQuery } from './types';
+import { defaultQuery, QueryFormat, VerticaDataSourceOptions, VerticaQuery } from './types';
 import AceEditor from 'react-ace';
 
 import 'brace/mode/sql';
@@ -11,35 +12,58 @@ import 'brace/ext/language_tools';
 
 type Props = QueryEditorProps<DataSource, VerticaQuery, VerticaDataSourceOptions>;
 
+const formatOptions: Array<SelectableValue<QueryFormat>> = [
+  { label: 'Table', value: 'table' },
+  { label: 'Time series', value: 'time_series' },
+  { label: 'Heatmap', value: 'heatmap' },
+];
+
 export class QueryEditor extends PureComponent<Props> {
   onQueryTextChange = (event: string) => {
     const { onChange, query } = this.props;
     onChange({ ...query, rawSql: event });
   };
 
+  onFormatChange = (option: SelectableValue<QueryFormat>) => {
+    const { onChange, onRunQuery, query } = this.props;
+    onChange({ ...query, format: option.value });
+    onRunQuery();
+  };
+
   render() {
     const query = defaults(this.props.query, defaultQuery);
-    const { rawSql } = query;
+    const { rawSql, format } = query;
     // @ts-ignore
     ace.config.set('basePath', 'public/app/core/components/code_editor/');
 
     return (
-      <div className="gf-form">
-        <AceEditor
-          theme={'grafana-dark'}
-          mode={'sql'}
-          onChange={this.onQueryTextChange}
-          value={rawSql || ''}
-          maxLines={10}
-          tabSize={2}
-          enableSnippets={true}
-          enableBasicAutocompletion={true}
-          showGutter={false}
-          highlightActiveLine={false}
-          showPrintMargin={false}
-          className={'gf-code-editor'}
-        />
-      </div>
+      <>
+        <div className="gf-form">
+          <AceEditor
+            theme={'grafana-dark'}
+            mode={'sql'}
+            onChange={this.onQueryTextChange}
+            value={rawSql || ''}
+            maxLines={10}
+            tabSize={2}
+            enableSnippets={true}
+            enableBasicAutocompletion={true}
+            showGutter={false}
+            highlightActiveLine={false}
+            showPrintMargin={false}
+            className={'gf-code-editor'}
+          />
+        </div>
+        <div className="gf-form">
+          <InlineFormLabel width={7}>Format as</InlineFormLabel>
+          <Select
+            width={20}
+            options={formatOptions}
+            value={formatOptions.find(o => o.value === format)}
+            onChange={this.onFormatChange}
+          />
+        </div>
+      </>
     );
   }
 }
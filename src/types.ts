@@ -1,7 +1,36 @@
 import { DataQuery, DataSourceJsonData } from '@grafana/data';
 
+export type QueryFormat = 'table' | 'time_series' | 'heatmap' | 'annotations';
+
 export interface VerticaQuery extends DataQuery {
   rawSql: string;
+  format?: QueryFormat;
+  resultShape?: 'wide';
+  fill?: 'none' | 'null' | 'zero' | 'previous';
+  gapThreshold?: number;
+  downsample?: 'avg' | 'min' | 'max' | 'last';
+  timeColumn?: string;
+  metricColumn?: string;
+  valueColumns?: string[];
+  timeColumnType?: 'auto' | 'seconds' | 'milliseconds' | 'microseconds' | 'nanoseconds' | 'string';
+  timeLayout?: string;
+  alias?: string;
+  transform?: 'none' | 'rate' | 'derivative';
+  timeAsString?: boolean;
+  transpose?: boolean;
+  timezone?: string;
+  snapTimeRange?: boolean;
+  searchFilter?: string;
+  unshiftTime?: boolean;
+  rawQuery?: boolean;
+  numericAsString?: boolean;
+  bigIntAsString?: boolean;
+  bigIntColumns?: string[];
+  intervalAsString?: boolean;
+  fullCellValues?: boolean;
+  arrayAsText?: boolean;
+  geoAsText?: boolean;
+  timePrecision?: 'ms' | 'us' | 'ns';
 }
 
 export const defaultQuery: Partial<VerticaQuery> = {
@@ -13,9 +42,40 @@ FROM \n\
 v_monitor.cpu_usage \n\
 WHERE \n\
 $__timeFilter(end_time)',
+  format: 'table',
 };
 
-export interface VerticaDataSourceOptions extends DataSourceJsonData {}
+export interface VerticaDataSourceOptions extends DataSourceJsonData {
+  seriesLimit?: number;
+  autoSortTimeSeries?: boolean;
+  nonFiniteFloats?: 'null' | 'string';
+  timeAsString?: boolean;
+  timezone?: string;
+  snapTimeRange?: boolean;
+  weekStart?: 'monday' | 'sunday';
+  timeSlice?: boolean;
+  numericAsString?: boolean;
+  bigIntAsString?: boolean;
+  binaryFormat?: 'hex' | 'base64';
+  binaryMaxBytes?: number;
+  intervalAsString?: boolean;
+  timestampZone?: string;
+  maxCellChars?: number;
+  trimCharPadding?: boolean;
+  geoAsText?: boolean;
+  maxOpenConnections?: number;
+  maxIdleConnections?: number;
+  connMaxLifetimeSeconds?: number;
+  connMaxIdleTimeSeconds?: number;
+  tlsmode?: 'none' | 'server' | 'server-strict';
+  tlsSkipVerify?: boolean;
+  queryTimeoutSeconds?: number;
+  connectionTimeoutSeconds?: number;
+  maxConcurrentQueries?: number;
+  subcluster?: string;
+  connectionParameters?: Record<string, string>;
+  minIdleConnections?: number;
+}
 export interface VerticaSecureJsonData {
   password?: string;
 }